@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/systray"
+	"github.com/godbus/dbus/v5"
+)
+
+type adapter struct {
+	path      dbus.ObjectPath
+	hci       string // e.g. hci0
+	address   string
+	name      string
+	powered   bool
+	soft      bool // rfkill soft/hard blocked
+	hard      bool
+	isDefault bool // the one bluetoothctl operates on
+}
+
+// problem describes why the adapter can't be used, "" if it can
+func (a adapter) problem() string {
+	switch {
+	case a.hard:
+		return "bluetooth is hard blocked, check the wireless switch"
+	case a.soft:
+		return "bluetooth is blocked by rfkill"
+	case !a.powered:
+		return "bluetooth adapter is off"
+	}
+	return ""
+}
+
+func (a adapter) state() string {
+	switch {
+	case a.hard:
+		return "hard blocked"
+	case a.soft:
+		return "blocked"
+	case !a.powered:
+		return "off"
+	}
+	return "on"
+}
+
+// adapters currently plugged, sorted by path
+var adapters []adapter
+var adaptersMtx sync.Mutex
+
+var adaptersMenu *systray.MenuItem
+
+// adapter address // menu, hidden when unplugged
+var adapterItems = make(map[string]*systray.MenuItem)
+
+func addAdaptersUI() {
+	adaptersMenu = systray.AddMenuItem("Adapters", "Bluetooth adapters")
+}
+
+func listAdapters() ([]adapter, error) {
+	objs, err := bluezManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	// bluetoothctl list: "Controller 00:1A:7D:DA:71:13 host [default]"
+	defaultAddr := ""
+	output, _ := btOptOut("list")
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); strings.Contains(line, "[default]") && len(fields) > 1 {
+			defaultAddr = fields[1]
+		}
+	}
+
+	list := make([]adapter, 0)
+	for path, ifaces := range objs {
+		props, ok := ifaces["org.bluez.Adapter1"]
+		if !ok {
+			continue
+		}
+
+		a := adapter{path: path, hci: filepath.Base(string(path))}
+		a.soft, a.hard = rfkillBlocked(a.hci)
+		a.address, _ = props["Address"].Value().(string)
+		a.name, _ = props["Alias"].Value().(string)
+		a.powered, _ = props["Powered"].Value().(bool)
+		a.isDefault = a.address == defaultAddr
+		list = append(list, a)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].path < list[j].path })
+	return list, nil
+}
+
+func currentAdapters() []adapter {
+	adaptersMtx.Lock()
+	defer adaptersMtx.Unlock()
+	return append([]adapter(nil), adapters...)
+}
+
+func defaultAdapter() dbus.ObjectPath {
+	for _, a := range currentAdapters() {
+		if a.isDefault {
+			return a.path
+		}
+	}
+	return ""
+}
+
+// refreshAdapters updates the adapters list and menu
+func refreshAdapters() {
+	list, err := listAdapters()
+	if err != nil {
+		btLog.Error("cant list adapters", "err", err)
+		setProblem("adapters", "cant list adapters: "+err.Error())
+		return
+	}
+	clearProblem("adapters")
+
+	adaptersMtx.Lock()
+	defer adaptersMtx.Unlock()
+	adapters = list
+
+	plugged := make(map[string]bool)
+	for _, a := range list {
+		item, ok := adapterItems[a.address]
+		if !ok {
+			item = adaptersMenu.AddSubMenuItemCheckbox("", "Power the adapter on/off", false)
+			adapterItems[a.address] = item
+			go adapterClicks(a.address, item)
+		}
+
+		title := fmt.Sprintf("%s (%s) — %s", a.name, a.address, a.state())
+		if a.isDefault {
+			title += ", default"
+		}
+		item.SetTitle(title)
+		item.SetTooltip(a.problem())
+		if a.powered {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+		item.Show()
+		plugged[a.address] = true
+	}
+
+	for address, item := range adapterItems {
+		if !plugged[address] {
+			item.Hide()
+		}
+	}
+
+	if len(list) > 0 {
+		adaptersMenu.Show()
+	} else {
+		adaptersMenu.Hide()
+	}
+
+	// bluebao is only degraded if no adapter is usable
+	title, problem := "Bluetooth: off", "no bluetooth adapter"
+	for _, a := range list {
+		if a.problem() == "" {
+			title, problem = "Bluetooth: on", ""
+			break
+		}
+		title, problem = "Bluetooth: "+a.state(), a.problem()
+	}
+	adaptersMenu.SetTitle(title)
+	if problem != "" {
+		setProblem("adapter", problem)
+	} else {
+		clearProblem("adapter")
+	}
+}
+
+// powerOn powers the default adapter on at startup, unless it's blocked
+func powerOn() {
+	for _, a := range currentAdapters() {
+		if a.isDefault && (a.soft || a.hard) {
+			btLog.Warn("adapter blocked, not powering on", "adapter", a.address)
+			return
+		}
+	}
+
+	if output, err := btOptOut("power", "on"); err != nil {
+		setProblem("adapter", "adapter power on failed: "+btFailure(output, err))
+		return
+	}
+	refreshAdapters()
+}
+
+// adapterProblem describes why an adapter can't be used, "" for the default adapter
+func adapterProblem(path dbus.ObjectPath) string {
+	for _, a := range currentAdapters() {
+		if a.path == path || (path == "" && a.isDefault) {
+			return a.problem()
+		}
+	}
+	return ""
+}
+
+func adapterClicks(address string, item *systray.MenuItem) {
+	for {
+		<-item.ClickedCh
+
+		for _, a := range currentAdapters() {
+			if a.address != address {
+				continue
+			}
+
+			if a.hard {
+				reportError(a.problem())
+				continue
+			}
+
+			// powering on a blocked adapter means unblocking it first
+			on := !a.powered || a.soft
+			if a.soft {
+				btLog.Info("unblocking adapter", "adapter", a.address)
+				if err := rfkillUnblock(a.hci); err != nil {
+					reportError(fmt.Sprintf("failed to unblock %s: %s", a.name, err))
+					continue
+				}
+			}
+
+			btLog.Info("powering adapter", "adapter", a.address, "on", on)
+			if !on {
+				expectDrops(a, true)
+			}
+			if err := setBluezProperty(a.path, "org.bluez.Adapter1", "Powered", on); err != nil {
+				expectDrops(a, false)
+				reportError(fmt.Sprintf("failed to power %s: %s", a.name, err))
+			}
+		}
+
+		refreshAdapters()
+	}
+}
+
+// expectDrops marks the devices connected through the adapter, powering it off isn't a loss
+func expectDrops(a adapter, expected bool) {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	for _, d := range localEndpoints {
+		if d.connected() && (d.adapter == a.path || (d.adapter == "" && a.isDefault)) {
+			d.dropExpected = expected
+		}
+	}
+}
+
+// adaptersChanged handles adapters being plugged or unplugged
+func adaptersChanged() {
+	refreshAdapters()
+	objs, _ := bluezManagedObjects()
+
+	localMtx.Lock()
+	for mac, d := range localEndpoints {
+		if !d.resolveAdapter(objs) {
+			// no adapter knows about the device anymore, it comes back on the next scan
+			btLog.Info("device unavailable", "device", d.name, "mac", mac)
+			d.remove()
+		}
+	}
+	localMtx.Unlock()
+
+	scanPairedDevices()
+}
+
+// resolveAdapter picks the adapter the device goes through: the configured one if the device
+// is paired there, else the default one, else any. Returns false if no adapter has the device.
+// objs are the bluez objects, nil without dbus. localMtx must be held.
+func (d *device) resolveAdapter(objs bluezObjects) bool {
+	if objs == nil {
+		d.adapter = "" // no dbus, bluetoothctl will do
+		return true
+	}
+
+	if len(currentAdapters()) == 0 {
+		d.adapter = "" // adapters unknown, bluetoothctl will do
+		return true
+	}
+
+	wanted := deviceConf(d.mac).Adapter
+	candidates := make([]adapter, 0)
+	for _, a := range currentAdapters() {
+		if _, ok := objs[a.path+"/dev_"+dbus.ObjectPath(d.audioID())]; ok {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+
+	chosen := candidates[0]
+	for _, a := range candidates {
+		if a.address == wanted || (wanted == "" && a.isDefault) {
+			chosen = a
+			break
+		}
+	}
+	d.adapter = chosen.path
+
+	// the adapter submenu only makes sense if there's a choice
+	for _, a := range candidates {
+		item, ok := d.adapterItems[a.address]
+		if !ok {
+			item = d.adapterMenu.AddSubMenuItemCheckbox(a.name+" ("+a.address+")", "Connect through this adapter", false)
+			d.adapterItems[a.address] = item
+			go d.adapterClicks(a.address, item)
+		}
+		if a.path == chosen.path {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+		item.Show()
+	}
+	for address, item := range d.adapterItems {
+		if !containsAdapter(candidates, address) {
+			item.Hide()
+		}
+	}
+	if len(candidates) > 1 {
+		d.adapterMenu.Show()
+	} else {
+		d.adapterMenu.Hide()
+	}
+
+	return true
+}
+
+func containsAdapter(list []adapter, address string) bool {
+	for _, a := range list {
+		if a.address == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *device) adapterClicks(address string, item *systray.MenuItem) {
+	for {
+		<-item.ClickedCh
+		updateConfig(d.mac, func(c *deviceConfig) { c.Adapter = address })
+		objs, _ := bluezManagedObjects()
+
+		localMtx.Lock()
+		d.resolveAdapter(objs)
+		localMtx.Unlock()
+	}
+}
+
+// devicePath is the bluez object of the device on its adapter
+func (d *device) devicePath() (dbus.ObjectPath, error) {
+	if d.adapter == "" {
+		return devicePath(d.mac)
+	}
+	return d.adapter + "/dev_" + dbus.ObjectPath(d.audioID()), nil
+}
+
+// bt runs a bluetoothctl command on the device, going through dbus for devices that are not on
+// the default adapter as bluetoothctl can't reach them
+func (d *device) bt(ctx context.Context, cmd string) (string, error) {
+	if d.adapter == "" || d.adapter == defaultAdapter() {
+		return btOptOutContext(ctx, cmd, d.mac)
+	}
+
+	path, _ := d.devicePath()
+	switch cmd {
+	case "info":
+		objs, err := bluezManagedObjects()
+		if err != nil {
+			return "", err
+		}
+		ifaces, ok := objs[path]
+		if !ok {
+			return "", fmt.Errorf("device %s not available", d.mac)
+		}
+		return dbusInfo(ifaces), nil
+	case "connect":
+		return "", bluezCall(ctx, path, "org.bluez.Device1.Connect")
+	case "disconnect":
+		return "", bluezCall(ctx, path, "org.bluez.Device1.Disconnect")
+	case "trust", "untrust":
+		return "", setBluezProperty(path, "org.bluez.Device1", "Trusted", cmd == "trust")
+	case "block", "unblock":
+		return "", setBluezProperty(path, "org.bluez.Device1", "Blocked", cmd == "block")
+	case "remove":
+		return "", bluezCall(ctx, d.adapter, "org.bluez.Adapter1.RemoveDevice", path)
+	}
+
+	return "", fmt.Errorf("unsupported command %s", cmd)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var audioBackendName = flag.String("ab", "auto", "audio backend: pulse (pulseaudio or pipewire-pulse), pipewire (wpctl), bluealsa or auto")
+
+// audioBackend is the sound server bluebao drives, see setupAudio
+type audioBackend interface {
+	name() string
+	sinks() ([]audioNode, error)
+	sources() ([]audioNode, error) // microphones, sink monitors are left out
+	cards() ([]audioCard, error)
+	playbacks() ([]audioStream, error)
+	recordings() ([]audioStream, error) // of microphones, monitors and peak meters are left out
+	defaultSink() (string, error)       // id
+	defaultSource() (string, error)     // id
+	setDefaultSink(id string) error
+	setDefaultSource(id string) error
+	setProfile(card audioCard, profile string) error
+	volume(sink audioNode) (int, error) // percentage
+	setVolume(sink audioNode, level int) error
+	movePlayback(s audioStream, sink audioNode) error
+	moveRecording(s audioStream, source audioNode) error
+	watchRecordings(changed chan<- struct{}) error // blocks, signals recordings coming and going
+}
+
+var errUnsupported = errors.New("not supported by the audio backend")
+
+var audio audioBackend
+
+// audioNode is a sink or a source
+type audioNode struct {
+	id    string // what the backend commands take
+	name  string // e.g. bluez_output.AA_BB_CC_DD_EE_FF.1
+	mac   string // bluetooth address, "" for other devices
+	props map[string]string
+}
+
+type audioCard struct {
+	id       string
+	name     string
+	mac      string
+	profile  string   // active
+	profiles []string // available
+}
+
+type audioStream struct {
+	id    string
+	props map[string]string
+}
+
+// e.g. bluez_output.AA_BB_CC_DD_EE_FF.1, bluez_sink.AA_BB_CC_DD_EE_FF.a2dp_sink, bluez_card.AA_BB_CC_DD_EE_FF
+var bluezNameRe = regexp.MustCompile(`^bluez_[a-z]+\.([0-9A-Fa-f]{2}(?:_[0-9A-Fa-f]{2}){5})\b`)
+
+// bluetoothMac returns the address of bluetooth nodes and cards. pipewire tags them with
+// api.bluez5.address, pulseaudio with device.string, both have it in the name otherwise.
+func bluetoothMac(props map[string]string, name string) string {
+	if mac := props["api.bluez5.address"]; mac != "" {
+		return strings.ToUpper(mac)
+	}
+	if props["device.api"] == "bluez" && props["device.string"] != "" {
+		return strings.ToUpper(props["device.string"])
+	}
+	if m := bluezNameRe.FindStringSubmatch(name); m != nil {
+		return strings.ToUpper(strings.ReplaceAll(m[1], "_", ":"))
+	}
+	return ""
+}
+
+// onDevice matches the nodes of the bluetooth device
+func onDevice(mac string) func(n audioNode) bool {
+	return func(n audioNode) bool {
+		return n.mac == mac
+	}
+}
+
+// findNode returns the first node matching, retrying while the audio server catches up
+func findNode(list func() ([]audioNode, error), attempts int, match func(n audioNode) bool) *audioNode {
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		nodes, err := list()
+		if err != nil {
+			continue
+		}
+		for _, n := range nodes {
+			if match(n) {
+				return &n
+			}
+		}
+	}
+	return nil
+}
+
+// findCard returns the card of the bluetooth device
+func findCard(mac string, attempts int) *audioCard {
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		cards, err := audio.cards()
+		if err != nil {
+			continue
+		}
+		for _, c := range cards {
+			if c.mac == mac {
+				return &c
+			}
+		}
+	}
+	return nil
+}
+
+// pickAudio returns the audio backend to use, and why it can't work if so. pactl works with
+// pulseaudio and pipewire-pulse alike.
+func pickAudio() (audioBackend, string) {
+	switch *audioBackendName {
+	case "pulse":
+		return pulseBackend{}, ""
+	case "pipewire":
+		return pipewireBackend{}, ""
+	case "bluealsa":
+		return bluealsaBackend{}, ""
+	}
+
+	// the tools may be installed without their server running
+	_, errPactl := runCmdTimeout(audioLog, 2*time.Second, "pactl", "info")
+	_, errWpctl := runCmdTimeout(audioLog, 2*time.Second, "wpctl", "status")
+	switch {
+	case errPactl == nil:
+		return pulseBackend{}, ""
+	case errWpctl == nil:
+		return pipewireBackend{}, ""
+	case bluealsaRunning():
+		return bluealsaBackend{}, ""
+	default:
+		return pulseBackend{}, "no audio server found (pactl, wpctl, bluealsa)"
+	}
+}
+
+func setupAudio() {
+	var problem string
+	audio, problem = pickAudio()
+	if problem != "" {
+		setProblem("audio", problem)
+	}
+	audioLog.Info("audio backend", "backend", audio.name())
+}
+
+// activeCodec returns the bluetooth codec of the device, if exposed
+func activeCodec(mac string) string {
+	sink := findNode(audio.sinks, 1, onDevice(mac))
+	if sink == nil {
+		return ""
+	}
+
+	// pipewire and pulseaudio name the property differently
+	for _, key := range []string{"api.bluez5.codec", "bluetooth.codec"} {
+		if codec := sink.props[key]; codec != "" {
+			return codec
+		}
+	}
+	return ""
+}
+
+func activeProfile(mac string) string {
+	card := findCard(mac, 1)
+	if card == nil {
+		return ""
+	}
+	return card.profile
+}
+
+// default sink before the bluetooth output took over, restored once it goes away
+var (
+	previousSink    string // id, "" is the system default with bluealsa
+	sinkSaved       bool
+	previousSinkMtx sync.Mutex
+)
+
+// setDefaultAudio makes the output of the bluetooth device the default, remembering the
+// previous one
+func setDefaultAudio(mac string) {
+	audioLog.Debug("trying to set default audio", "output", mac)
+	sink := findNode(audio.sinks, 20, onDevice(mac))
+	if sink == nil {
+		audioLog.Warn("failed to find sink", "output", mac)
+		reportError("no audio output matching " + mac)
+		notify(notifySink, "Default sink not found", "No audio output matching "+mac)
+		return
+	}
+
+	current, err := audio.defaultSink()
+	previousSinkMtx.Lock()
+	if err == nil && current != sink.id && !sinkSaved {
+		previousSink, sinkSaved = current, true
+	}
+	previousSinkMtx.Unlock()
+
+	useSink(*sink)
+}
+
+// restoreDefaultSink goes back to the output in use before the bluetooth one
+func restoreDefaultSink() {
+	previousSinkMtx.Lock()
+	id, saved := previousSink, sinkSaved
+	previousSink, sinkSaved = "", false
+	previousSinkMtx.Unlock()
+
+	if !saved {
+		return
+	}
+
+	// it may have been unplugged meanwhile, the server picks another one then
+	sink := findNode(audio.sinks, 1, func(n audioNode) bool { return n.id == id })
+	if sink == nil {
+		audioLog.Warn("previous default sink is gone", "sink", id)
+		return
+	}
+	useSink(*sink)
+}
+
+func useSink(sink audioNode) {
+	if err := audio.setDefaultSink(sink.id); err != nil {
+		audioLog.Error("failed to set default audio", "sink", sink.name, "err", err)
+		reportError("failed to set default audio: " + err.Error())
+		return
+	}
+	audioLog.Info("default audio set", "sink", sink.name)
+	moveSinkInputs(sink)
+}
+
+func setProfile(mac string, profile string) {
+	card := findCard(mac, 20)
+	if card == nil {
+		reportError("no bluetooth audio card found")
+		return
+	}
+	if err := audio.setProfile(*card, profile); err != nil {
+		audioLog.Error("failed to set audio profile", "card", card.name, "profile", profile, "err", err)
+		reportError("failed to set audio profile " + profile + ": " + err.Error())
+		return
+	}
+
+	// the microphone comes and goes with the headset profile
+	if profile == "headset-head-unit" {
+		if !useBluetoothSource(card.mac, 20) {
+			reportError("no bluetooth microphone found")
+		}
+	} else {
+		restoreDefaultSource()
+	}
+}
+
+// connectedMac returns the address of the connected device, "" if none
+func connectedMac() string {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	for _, d := range localEndpoints {
+		if d.connected() {
+			return d.mac
+		}
+	}
+	return ""
+}
+
+// setConnectedProfile sets the profile of the connected device, for the global profile menu
+func setConnectedProfile(profile string) {
+	mac := connectedMac()
+	if mac == "" {
+		reportError("no bluetooth device connected")
+		return
+	}
+	setProfile(mac, profile)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestBluetoothMac(t *testing.T) {
+	tests := []struct {
+		props map[string]string
+		name  string
+		want  string
+	}{
+		{map[string]string{"api.bluez5.address": "aa:bb:cc:dd:ee:ff"}, "bluez_output.AA_BB_CC_DD_EE_FF.1", "AA:BB:CC:DD:EE:FF"},
+		{map[string]string{"device.api": "bluez", "device.string": "aa:bb:cc:dd:ee:ff"}, "", "AA:BB:CC:DD:EE:FF"},
+		{map[string]string{"device.api": "alsa", "device.string": "front:1"}, "alsa_output.pci-0000_00_1f.3.analog-stereo", ""},
+		{nil, "bluez_output.AA_BB_CC_DD_EE_FF.1", "AA:BB:CC:DD:EE:FF"},
+		{nil, "bluez_sink.aa_bb_cc_dd_ee_ff.a2dp_sink", "AA:BB:CC:DD:EE:FF"},
+		{nil, "bluez_card.AA_BB_CC_DD_EE_FF", "AA:BB:CC:DD:EE:FF"},
+		{nil, "bluez_sink.AA_BB_CC_DD_EE", ""},
+		{nil, "alsa_output.bluez_sink.AA_BB_CC_DD_EE_FF", ""},
+	}
+	for _, tt := range tests {
+		if got := bluetoothMac(tt.props, tt.name); got != tt.want {
+			t.Errorf("bluetoothMac(%v, %q) = %q, want %q", tt.props, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/godbus/dbus/v5"
+)
+
+const inRangeInterval = 30 * time.Second
+const resumeDelay = 5 * time.Second
+const resumeAttempts = 3
+
+// addAutoConnectUI adds the auto-connect rules to the device submenu
+func (d *device) addAutoConnectUI() {
+	c := deviceConf(d.mac)
+	menu := d.menu.AddSubMenuItem("Auto-connect", "Connect the device automatically")
+	startup := menu.AddSubMenuItemCheckbox("On startup", "Connect when bluebao starts, unless a peer holds it", c.ConnectOnStartup)
+	resume := menu.AddSubMenuItemCheckbox("After resume", "Reconnect after suspend if it was connected", c.ReconnectOnResume)
+	inRange := menu.AddSubMenuItemCheckbox("When in range", "Connect whenever the device is reachable, unless a peer holds it", c.ConnectWhenInRange)
+	keep := menu.AddSubMenuItemCheckbox("Keep connected", "Reconnect if the connection drops unexpectedly", c.KeepConnected)
+
+	go d.ruleClicks(startup, func(c *deviceConfig, on bool) { c.ConnectOnStartup = on })
+	go d.ruleClicks(resume, func(c *deviceConfig, on bool) { c.ReconnectOnResume = on })
+	go d.ruleClicks(inRange, func(c *deviceConfig, on bool) { c.ConnectWhenInRange = on })
+	go d.ruleClicks(keep, func(c *deviceConfig, on bool) { c.KeepConnected = on })
+}
+
+func (d *device) ruleClicks(item *systray.MenuItem, set func(c *deviceConfig, on bool)) {
+	for {
+		<-item.ClickedCh
+		on := !item.Checked()
+		updateConfig(d.mac, func(c *deviceConfig) { set(c, on) })
+		if on {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+}
+
+// ruleDevices returns the devices a rule applies to, connected or not
+func ruleDevices(rule func(c deviceConfig) bool, connected bool) []string {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	macs := make([]string, 0)
+	for mac, d := range localEndpoints {
+		if d.connected() == connected && rule(deviceConf(mac)) {
+			macs = append(macs, mac)
+		}
+	}
+	sort.Strings(macs)
+	return macs
+}
+
+// autoConnect connects a device without user interaction. It gives up quietly if a device is
+// already connected, if a peer holds it or if it can't be reached.
+func autoConnect(mac string, reason string) bool {
+	localMtx.Lock()
+	d, ok := localEndpoints[mac]
+	busy := !ok || d.state != stateIdle || adapterProblem(d.adapter) != ""
+	for _, other := range localEndpoints {
+		busy = busy || other.state != stateIdle
+	}
+	localMtx.Unlock()
+	if busy {
+		return false
+	}
+
+	if peerHolds(mac) {
+		btLog.Info("not auto-connecting, a peer holds the device", "device", d.name, "reason", reason)
+		return false
+	}
+
+	// no takeover broadcast, we just made sure nobody holds it
+	localMtx.Lock()
+	done := d.connect(true)
+	localMtx.Unlock()
+	<-done
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if !d.connected() {
+		return false
+	}
+	btLog.Info("auto-connected", "device", d.name, "reason", reason)
+	return true
+}
+
+func connectOnStartup() {
+	for _, mac := range ruleDevices(func(c deviceConfig) bool { return c.ConnectOnStartup }, false) {
+		if autoConnect(mac, "startup") {
+			return
+		}
+	}
+}
+
+// watchInRange connects devices coming back in range. Nothing tells when an idle device is
+// reachable but connecting to it, so only devices last seen out of range are tried: a drop or a
+// failed page marks them. A device disconnected while in range, e.g. by the user, stays so until
+// it's seen out of range again.
+func watchInRange() {
+	for {
+		time.Sleep(inRangeInterval)
+
+		for _, mac := range ruleDevices(func(c deviceConfig) bool { return c.ConnectWhenInRange }, false) {
+			if wasAway(mac) && autoConnect(mac, "in range") {
+				break
+			}
+		}
+	}
+}
+
+func wasAway(mac string) bool {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+	d, ok := localEndpoints[mac]
+	return ok && d.away
+}
+
+// watchSleep reconnects the devices that were connected before a suspend, via logind
+func watchSleep() {
+	conn, err := systemBus()
+	if err != nil {
+		btLog.Error("cant watch suspend", "err", err)
+		return
+	}
+
+	err = conn.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.login1.Manager"), dbus.WithMatchMember("PrepareForSleep"))
+	if err != nil {
+		btLog.Error("cant watch suspend", "err", err)
+		return
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	var wasConnected []string
+	for sig := range signals {
+		if sig.Name != "org.freedesktop.login1.Manager.PrepareForSleep" || len(sig.Body) != 1 {
+			continue
+		}
+
+		if sleeping, _ := sig.Body[0].(bool); sleeping {
+			wasConnected = ruleDevices(func(c deviceConfig) bool { return c.ReconnectOnResume }, true)
+			btLog.Info("suspending", "reconnect", wasConnected)
+			continue
+		}
+
+		go func(macs []string) {
+			// the adapter takes a moment to come back
+			for i := 0; i < resumeAttempts && len(macs) > 0; i++ {
+				time.Sleep(resumeDelay)
+				for _, mac := range macs {
+					if autoConnect(mac, "resume") {
+						return
+					}
+				}
+			}
+		}(wasConnected)
+	}
+}
+
+// deviceConnectionChanged keeps the menu in sync with connections bluebao didn't make, e.g. a
+// headset reconnecting on its own when back in range
+func deviceConnectionChanged(path dbus.ObjectPath, connected bool) {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	d := deviceAt(path)
+	if d == nil {
+		return
+	}
+
+	// the worker handles the connections it makes
+	if d.state == stateConnecting || d.state == stateDisconnecting {
+		return
+	}
+
+	if connected && !d.connected() {
+		d.onConnected()
+	} else if !connected && d.connected() && d.dropExpected {
+		d.onDisconnected()
+	} else if !connected && d.connected() {
+		// bluebao's other disconnections go through the worker, so this one is unexpected
+		btLog.Warn("connection lost", "device", d.name, "mac", d.mac)
+		d.onDisconnected()
+		d.away = true
+		if deviceConf(d.mac).KeepConnected {
+			d.startReconnect()
+		}
+	}
+}
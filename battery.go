@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+var batteryThreshold = flag.Int("lb", 20, "low battery notification threshold in percent, 0 to disable")
+
+// bluetoothctl info reports e.g. "Battery Percentage: 0x48 (72)"
+var batteryRe = regexp.MustCompile(`Battery Percentage: 0x[0-9a-fA-F]+ \((\d+)\)`)
+
+func parseBattery(info string) int {
+	m := batteryRe.FindStringSubmatch(info)
+	if m == nil {
+		return -1
+	}
+
+	level, err := strconv.Atoi(m[1])
+	if err != nil {
+		return -1
+	}
+	return level
+}
+
+func updateBattery(d *device, info string) {
+	setBattery(d, parseBattery(info))
+}
+
+// setBattery records the battery level, -1 if unknown. localMtx must be held.
+func setBattery(d *device, level int) {
+	prev := d.battery
+	d.battery = level
+	d.refreshLabel()
+
+	// only notify when crossing the threshold, not on every change
+	low := *batteryThreshold
+	if low > 0 && d.battery >= 0 && d.battery <= low && (prev < 0 || prev > low) {
+		go notify(notifyBattery, "Low battery", fmt.Sprintf("%s is at %d%%", d.name, d.battery))
+	}
+}
+
+// batteryChanged follows the level bluez reports, path being the device object
+func batteryChanged(path dbus.ObjectPath, level int) {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if d := deviceAt(path); d != nil && d.connected() {
+		setBattery(d, level)
+	}
+}
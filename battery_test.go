@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestParseBattery(t *testing.T) {
+	tests := []struct {
+		info string
+		want int
+	}{
+		{"Device AA:BB:CC:DD:EE:FF (public)\n\tConnected: yes\n\tBattery Percentage: 0x48 (72)", 72},
+		{"\tBattery Percentage: 0x64 (100)", 100},
+		{"\tBattery Percentage: 0x00 (0)", 0},
+		{"\tBattery Percentage: 0x0A (10)", 10},
+		{"\tBattery Percentage: 72", -1},
+		{"Device AA:BB:CC:DD:EE:FF (public)\n\tConnected: yes", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := parseBattery(tt.info); got != tt.want {
+			t.Errorf("parseBattery(%q) = %d, want %d", tt.info, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const bluealsaService = "org.bluealsa"
+
+// bluealsaBackend drives bluealsa (4+) over dbus, for systems without a sound server. There is
+// no default device nor stream routing in ALSA: bluebao writes the default pcm to an asoundrc,
+// included by ~/.asoundrc.
+type bluealsaBackend struct{}
+
+// pcms used as ALSA default, by dbus path, "" for the system default
+var (
+	bluealsaSink, bluealsaSource string
+	bluealsaMtx                  sync.Mutex
+)
+
+type bluealsaPCM struct {
+	path      dbus.ObjectPath
+	mac       string
+	transport string // e.g. A2DP-source, HFP-AG
+	mode      string // sink for playback, source for capture
+	codec     string
+}
+
+// profile is how the pcm is addressed in ALSA, a2dp or sco
+func (p bluealsaPCM) profile() string {
+	if strings.HasPrefix(p.transport, "A2DP") {
+		return "a2dp"
+	}
+	return "sco"
+}
+
+func (p bluealsaPCM) node() audioNode {
+	return audioNode{
+		id:    string(p.path),
+		name:  bluealsaSpec(p.mac, p.profile()),
+		mac:   p.mac,
+		props: map[string]string{"bluetooth.codec": p.codec, "bluealsa.transport": p.transport},
+	}
+}
+
+// fallback is the system default, in use until a bluetooth device takes over
+var bluealsaFallback = audioNode{id: "", name: "sysdefault"}
+
+func bluealsaRunning() bool {
+	conn, err := systemBus()
+	if err != nil {
+		return false
+	}
+
+	var running bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, bluealsaService).Store(&running)
+	return err == nil && running
+}
+
+// bluealsaPCMs lists the pcms, the default ones first then a2dp ones first
+func bluealsaPCMs() ([]bluealsaPCM, error) {
+	conn, err := systemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := dbusContext(context.Background())
+	defer cancel()
+
+	var objs map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	err = conn.Object(bluealsaService, "/org/bluealsa").CallWithContext(ctx, "org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&objs)
+	if err != nil {
+		audioLog.Error("cant list bluealsa pcms", "err", err)
+		return nil, err
+	}
+
+	pcms := make([]bluealsaPCM, 0)
+	for path, ifaces := range objs {
+		props, ok := ifaces["org.bluealsa.PCM1"]
+		if !ok {
+			continue
+		}
+
+		dev, _ := props["Device"].Value().(dbus.ObjectPath)
+		p := bluealsaPCM{path: path, mac: strings.ReplaceAll(strings.TrimPrefix(filepath.Base(string(dev)), "dev_"), "_", ":")}
+		p.transport, _ = props["Transport"].Value().(string)
+		p.mode, _ = props["Mode"].Value().(string)
+		p.codec, _ = props["Codec"].Value().(string)
+		pcms = append(pcms, p)
+	}
+
+	bluealsaMtx.Lock()
+	sink, source := bluealsaSink, bluealsaSource
+	bluealsaMtx.Unlock()
+	isDefault := func(p bluealsaPCM) bool { return string(p.path) == sink || string(p.path) == source }
+	sort.Slice(pcms, func(i, j int) bool {
+		if isDefault(pcms[i]) != isDefault(pcms[j]) {
+			return isDefault(pcms[i])
+		}
+		if pcms[i].profile() != pcms[j].profile() {
+			return pcms[i].profile() == "a2dp"
+		}
+		return pcms[i].path < pcms[j].path
+	})
+	return pcms, nil
+}
+
+func bluealsaPCMCall(path string, method string, args ...interface{}) *dbus.Call {
+	conn, err := systemBus()
+	if err != nil {
+		return &dbus.Call{Err: err}
+	}
+
+	ctx, cancel := dbusContext(context.Background())
+	defer cancel()
+	return conn.Object(bluealsaService, dbus.ObjectPath(path)).CallWithContext(ctx, method, 0, args...)
+}
+
+func asoundrcPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "asoundrc")
+}
+
+// writeAsoundrc points the ALSA default to the chosen pcms. bluealsaMtx must be held.
+func writeAsoundrc() error {
+	content := "# written by bluebao, changes are overwritten\n"
+	if bluealsaSink != "" || bluealsaSource != "" {
+		slave := func(path string) string {
+			if path == "" {
+				return bluealsaFallback.name
+			}
+			return pathSpec(path)
+		}
+		content += fmt.Sprintf("pcm.!default {\n\ttype asym\n\tplayback.pcm {\n\t\ttype plug\n\t\tslave.pcm \"%s\"\n\t}\n\tcapture.pcm {\n\t\ttype plug\n\t\tslave.pcm \"%s\"\n\t}\n}\n",
+			slave(bluealsaSink), slave(bluealsaSource))
+	}
+
+	path := asoundrcPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return err
+	}
+
+	// ALSA only reads ~/.asoundrc, include ours in it
+	home, _ := os.UserHomeDir()
+	userrc := filepath.Join(home, ".asoundrc")
+	include := "<" + path + ">"
+	existing, err := os.ReadFile(userrc)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.WriteFile(userrc, []byte(include+"\n"), 0o644)
+	}
+	if !strings.Contains(string(existing), include) {
+		// don't edit the user's file, without the line ALSA ignores bluebao's default pcm
+		audioLog.Warn("add the bluebao default pcm to ~/.asoundrc", "line", include)
+		setProblem("asoundrc", "add "+include+" to ~/.asoundrc")
+		return nil
+	}
+	clearProblem("asoundrc")
+	return nil
+}
+
+// bluealsaSpec is how ALSA addresses the pcm
+func bluealsaSpec(mac string, profile string) string {
+	return fmt.Sprintf("bluealsa:DEV=%s,PROFILE=%s", mac, profile)
+}
+
+// pathSpec builds the ALSA name from the pcm path, e.g. /org/bluealsa/hci0/dev_AA_BB_CC_DD_EE_FF/a2dpsrc/sink
+func pathSpec(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "dev_") {
+			continue
+		}
+		profile := "sco"
+		if i+1 < len(parts) && strings.HasPrefix(parts[i+1], "a2dp") {
+			profile = "a2dp"
+		}
+		return bluealsaSpec(strings.ReplaceAll(strings.TrimPrefix(part, "dev_"), "_", ":"), profile)
+	}
+	return bluealsaFallback.name
+}
+
+func (bluealsaBackend) name() string {
+	return "bluealsa"
+}
+
+func (bluealsaBackend) nodes(keep func(p bluealsaPCM) bool) ([]audioNode, error) {
+	pcms, err := bluealsaPCMs()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]audioNode, 0, len(pcms)+1)
+	for _, p := range pcms {
+		if keep(p) {
+			nodes = append(nodes, p.node())
+		}
+	}
+	return append(nodes, bluealsaFallback), nil
+}
+
+func (b bluealsaBackend) sinks() ([]audioNode, error) {
+	return b.nodes(func(p bluealsaPCM) bool { return p.mode == "sink" })
+}
+
+// a2dp capture is a phone streaming to us, not a microphone
+func (b bluealsaBackend) sources() ([]audioNode, error) {
+	return b.nodes(func(p bluealsaPCM) bool { return p.mode == "source" && p.profile() == "sco" })
+}
+
+// cards groups the pcms by device, the profile is the one of the default playback pcm
+func (bluealsaBackend) cards() ([]audioCard, error) {
+	pcms, err := bluealsaPCMs()
+	if err != nil {
+		return nil, err
+	}
+
+	bluealsaMtx.Lock()
+	sink := bluealsaSink
+	bluealsaMtx.Unlock()
+
+	cards := make([]audioCard, 0)
+	byMac := make(map[string]int)
+	for _, p := range pcms {
+		if p.mode != "sink" {
+			continue
+		}
+		i, ok := byMac[p.mac]
+		if !ok {
+			i = len(cards)
+			byMac[p.mac] = i
+			cards = append(cards, audioCard{id: p.mac, name: "bluealsa " + p.mac, mac: p.mac, profile: "a2dp-sink"})
+		}
+
+		profile := "a2dp-sink"
+		if p.profile() == "sco" {
+			profile = "headset-head-unit"
+		}
+		cards[i].profiles = append(cards[i].profiles, profile)
+		if string(p.path) == sink {
+			cards[i].profile = profile
+		}
+	}
+	return cards, nil
+}
+
+// ALSA has no streams to route
+func (bluealsaBackend) playbacks() ([]audioStream, error) {
+	return nil, nil
+}
+
+func (bluealsaBackend) recordings() ([]audioStream, error) {
+	return nil, nil
+}
+
+func (bluealsaBackend) defaultSink() (string, error) {
+	bluealsaMtx.Lock()
+	defer bluealsaMtx.Unlock()
+	return bluealsaSink, nil
+}
+
+func (bluealsaBackend) defaultSource() (string, error) {
+	bluealsaMtx.Lock()
+	defer bluealsaMtx.Unlock()
+	return bluealsaSource, nil
+}
+
+// setDefaultSink to the fallback goes back to the system default altogether
+func (bluealsaBackend) setDefaultSink(id string) error {
+	bluealsaMtx.Lock()
+	defer bluealsaMtx.Unlock()
+
+	bluealsaSink = id
+	if id == "" {
+		bluealsaSource = ""
+	}
+	return writeAsoundrc()
+}
+
+func (bluealsaBackend) setDefaultSource(id string) error {
+	bluealsaMtx.Lock()
+	defer bluealsaMtx.Unlock()
+
+	bluealsaSource = id
+	return writeAsoundrc()
+}
+
+// setProfile switches between A2DP and SCO by moving the default pcm, bluealsa keeps both up
+func (b bluealsaBackend) setProfile(card audioCard, profile string) error {
+	want := "a2dp"
+	if profile == "headset-head-unit" {
+		want = "sco"
+	}
+
+	pcms, err := bluealsaPCMs()
+	if err != nil {
+		return err
+	}
+	for _, p := range pcms {
+		if p.mac != card.mac || p.mode != "sink" || p.profile() != want {
+			continue
+		}
+
+		bluealsaMtx.Lock()
+		defer bluealsaMtx.Unlock()
+		bluealsaSink = string(p.path)
+		if want == "a2dp" {
+			bluealsaSource = ""
+		}
+		return writeAsoundrc()
+	}
+	return fmt.Errorf("no %s pcm for %s", want, card.mac)
+}
+
+// volume reads the first channel, bluealsa packs both in an uint16: mute bit then 0-127
+func (bluealsaBackend) volume(sink audioNode) (int, error) {
+	if sink.id == "" {
+		return -1, errUnsupported
+	}
+
+	var v dbus.Variant
+	err := bluealsaPCMCall(sink.id, "org.freedesktop.DBus.Properties.Get", "org.bluealsa.PCM1", "Volume").Store(&v)
+	if err != nil {
+		return -1, err
+	}
+	volume, ok := v.Value().(uint16)
+	if !ok {
+		return -1, fmt.Errorf("unexpected volume %v", v)
+	}
+	return unpackVolume(volume), nil
+}
+
+func (bluealsaBackend) setVolume(sink audioNode, level int) error {
+	if sink.id == "" {
+		return errUnsupported
+	}
+
+	return bluealsaPCMCall(sink.id, "org.freedesktop.DBus.Properties.Set", "org.bluealsa.PCM1", "Volume", dbus.MakeVariant(packVolume(level))).Err
+}
+
+// bluealsa packs a 0-127 level per channel, left in the high byte, bit 7 of each byte is mute
+func unpackVolume(v uint16) int {
+	return (int((v>>8)&0x7f)*100 + 63) / 127
+}
+
+func packVolume(level int) uint16 {
+	v := uint16((min(max(level, 0), 100)*127 + 50) / 100)
+	return v<<8 | v
+}
+
+func (bluealsaBackend) movePlayback(s audioStream, sink audioNode) error {
+	return errUnsupported
+}
+
+func (bluealsaBackend) moveRecording(s audioStream, source audioNode) error {
+	return errUnsupported
+}
+
+func (bluealsaBackend) watchRecordings(changed chan<- struct{}) error {
+	return errUnsupported
+}
+
+// a2dpPCM returns the a2dp playback pcm of the card, the one codecs apply to
+func (bluealsaBackend) a2dpPCM(card audioCard) (string, error) {
+	pcms, err := bluealsaPCMs()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range pcms {
+		if p.mac == card.mac && p.mode == "sink" && p.profile() == "a2dp" {
+			return string(p.path), nil
+		}
+	}
+	return "", fmt.Errorf("no a2dp pcm for %s", card.mac)
+}
+
+func (b bluealsaBackend) listCodecs(card audioCard) ([]string, error) {
+	path, err := b.a2dpPCM(card)
+	if err != nil {
+		return nil, err
+	}
+
+	var codecs map[string]map[string]dbus.Variant
+	if err := bluealsaPCMCall(path, "org.bluealsa.PCM1.GetCodecs").Store(&codecs); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (b bluealsaBackend) switchCodec(card audioCard, codec string) error {
+	path, err := b.a2dpPCM(card)
+	if err != nil {
+		return err
+	}
+	return bluealsaPCMCall(path, "org.bluealsa.PCM1.SelectCodec", codec, map[string]dbus.Variant{}).Err
+}
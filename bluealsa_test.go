@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestPathSpec(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/org/bluealsa/hci0/dev_AA_BB_CC_DD_EE_FF/a2dpsrc/sink", "bluealsa:DEV=AA:BB:CC:DD:EE:FF,PROFILE=a2dp"},
+		{"/org/bluealsa/hci1/dev_AA_BB_CC_DD_EE_FF/a2dpsnk/source", "bluealsa:DEV=AA:BB:CC:DD:EE:FF,PROFILE=a2dp"},
+		{"/org/bluealsa/hci0/dev_AA_BB_CC_DD_EE_FF/hfpag/sink", "bluealsa:DEV=AA:BB:CC:DD:EE:FF,PROFILE=sco"},
+		{"/org/bluealsa/hci0/dev_AA_BB_CC_DD_EE_FF/hspag/source", "bluealsa:DEV=AA:BB:CC:DD:EE:FF,PROFILE=sco"},
+		{"/org/bluealsa/hci0/dev_AA_BB_CC_DD_EE_FF", "bluealsa:DEV=AA:BB:CC:DD:EE:FF,PROFILE=sco"},
+		{"", "sysdefault"},
+	}
+	for _, tt := range tests {
+		if got := pathSpec(tt.path); got != tt.want {
+			t.Errorf("pathSpec(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestVolumePacking(t *testing.T) {
+	tests := []struct {
+		level int
+		want  uint16
+	}{
+		{0, 0x0000},
+		{1, 0x0101},
+		{50, 0x4040},
+		{100, 0x7f7f},
+		{150, 0x7f7f},
+		{-5, 0x0000},
+	}
+	for _, tt := range tests {
+		if got := packVolume(tt.level); got != tt.want {
+			t.Errorf("packVolume(%d) = %#04x, want %#04x", tt.level, got, tt.want)
+		}
+	}
+
+	for level := 0; level <= 100; level++ {
+		if got := unpackVolume(packVolume(level)); got != level {
+			t.Errorf("unpackVolume(packVolume(%d)) = %d", level, got)
+		}
+	}
+
+	// the mute bits don't change the level
+	if got := unpackVolume(0xc0c0); got != 50 {
+		t.Errorf("unpackVolume(0xc0c0) = %d, want 50", got)
+	}
+}
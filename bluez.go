@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const bluezService = "org.bluez"
+
+var sysBus *dbus.Conn
+var sysBusMtx sync.Mutex
+
+// systemBus returns a shared connection to the system bus, where bluez lives
+func systemBus() (*dbus.Conn, error) {
+	sysBusMtx.Lock()
+	defer sysBusMtx.Unlock()
+
+	if sysBus != nil && sysBus.Connected() {
+		return sysBus, nil
+	}
+
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	sysBus = conn
+	return conn, nil
+}
+
+// dbusContext bounds dbus calls like external commands
+func dbusContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, *cmdTimeout)
+}
+
+type bluezObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+func bluezManagedObjects() (bluezObjects, error) {
+	conn, err := systemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := dbusContext(context.Background())
+	defer cancel()
+
+	var objs bluezObjects
+	err = conn.Object(bluezService, "/").CallWithContext(ctx, "org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&objs)
+	return objs, err
+}
+
+// devicePath looks up the bluez object of a device from its mac address
+func devicePath(mac string) (dbus.ObjectPath, error) {
+	objs, err := bluezManagedObjects()
+	if err != nil {
+		return "", err
+	}
+
+	for path, ifaces := range objs {
+		dev, ok := ifaces["org.bluez.Device1"]
+		if !ok {
+			continue
+		}
+		if addr, _ := dev["Address"].Value().(string); addr == mac {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("device %s not found", mac)
+}
+
+// deviceAt returns the device of a bluez object, nil if unknown or known through another
+// adapter than the one in use. localMtx must be held.
+func deviceAt(path dbus.ObjectPath) *device {
+	mac := strings.ReplaceAll(strings.TrimPrefix(filepath.Base(string(path)), "dev_"), "_", ":")
+	d, ok := localEndpoints[mac]
+	if !ok {
+		return nil
+	}
+	if d.adapter != "" && filepath.Dir(string(path)) != string(d.adapter) {
+		return nil
+	}
+	return d
+}
+
+func setBluezProperty(path dbus.ObjectPath, iface string, property string, value interface{}) error {
+	conn, err := systemBus()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbusContext(context.Background())
+	defer cancel()
+
+	return conn.Object(bluezService, path).CallWithContext(ctx, "org.freedesktop.DBus.Properties.Set", 0,
+		iface, property, dbus.MakeVariant(value)).Err
+}
+
+// bluezCall calls a bluez method, logging it like external commands
+func bluezCall(parent context.Context, path dbus.ObjectPath, method string, args ...interface{}) error {
+	conn, err := systemBus()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	ctx, cancel := dbusContext(parent)
+	defer cancel()
+	err = conn.Object(bluezService, path).CallWithContext(ctx, method, 0, args...).Err
+
+	attrs := []any{"path", path, "method", method, "duration", time.Since(start)}
+	if err != nil {
+		btLog.Warn("dbus call failed", append(attrs, "err", err)...)
+	} else {
+		btLog.Debug("dbus call", attrs...)
+	}
+	return err
+}
+
+// names of the uuids we care about, as shown by bluetoothctl
+var uuidNames = map[string]string{
+	"0000110a-0000-1000-8000-00805f9b34fb": "Audio Source",
+	"0000110b-0000-1000-8000-00805f9b34fb": "Audio Sink",
+	"0000110c-0000-1000-8000-00805f9b34fb": "A/V Remote Control Target",
+	"0000110e-0000-1000-8000-00805f9b34fb": "A/V Remote Control",
+	"00001108-0000-1000-8000-00805f9b34fb": "Headset",
+	"00001112-0000-1000-8000-00805f9b34fb": "Headset AG",
+	"0000111e-0000-1000-8000-00805f9b34fb": "Handsfree",
+	"0000111f-0000-1000-8000-00805f9b34fb": "Handsfree Audio Gateway",
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// dbusInfo renders the interfaces of a device object the way bluetoothctl info does, for
+// devices bluetoothctl can't see as they're not on the default adapter
+func dbusInfo(ifaces map[string]map[string]dbus.Variant) string {
+	dev := ifaces["org.bluez.Device1"]
+	str := func(key string) string { v, _ := dev[key].Value().(string); return v }
+	flag := func(key string) string { v, _ := dev[key].Value().(bool); return yesNo(v) }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Device %s\n", str("Address"))
+	fmt.Fprintf(&b, "\tName: %s\n", str("Name"))
+	fmt.Fprintf(&b, "\tAlias: %s\n", str("Alias"))
+	if class, ok := dev["Class"].Value().(uint32); ok {
+		fmt.Fprintf(&b, "\tClass: 0x%08x\n", class)
+	}
+	if icon := str("Icon"); icon != "" {
+		fmt.Fprintf(&b, "\tIcon: %s\n", icon)
+	}
+	for _, key := range []string{"Paired", "Trusted", "Blocked", "Connected"} {
+		fmt.Fprintf(&b, "\t%s: %s\n", key, flag(key))
+	}
+
+	uuids, _ := dev["UUIDs"].Value().([]string)
+	for _, uuid := range uuids {
+		name, ok := uuidNames[uuid]
+		if !ok {
+			name = "Unknown"
+		}
+		fmt.Fprintf(&b, "\tUUID: %s (%s)\n", name, uuid)
+	}
+
+	if level, ok := ifaces["org.bluez.Battery1"]["Percentage"].Value().(byte); ok {
+		fmt.Fprintf(&b, "\tBattery Percentage: 0x%02x (%d)\n", level, level)
+	}
+
+	return b.String()
+}
+
+// watchBluez follows bluez objects coming and going, and their property changes
+func watchBluez() {
+	conn, err := systemBus()
+	if err != nil {
+		btLog.Error("cant watch bluez", "err", err)
+		return
+	}
+
+	for _, iface := range []string{"org.freedesktop.DBus.ObjectManager", "org.freedesktop.DBus.Properties"} {
+		err := conn.AddMatchSignal(dbus.WithMatchSender(bluezService), dbus.WithMatchInterface(iface))
+		if err != nil {
+			btLog.Error("cant watch bluez", "err", err)
+			return
+		}
+	}
+
+	signals := make(chan *dbus.Signal, 64)
+	conn.Signal(signals)
+
+	for sig := range signals {
+		switch sig.Name {
+		case "org.freedesktop.DBus.ObjectManager.InterfacesAdded":
+			var ifaces map[string]map[string]dbus.Variant
+			if len(sig.Body) == 2 && dbus.Store(sig.Body[1:], &ifaces) == nil {
+				if _, ok := ifaces["org.bluez.Adapter1"]; ok {
+					btLog.Info("adapter added", "path", sig.Body[0])
+					go adaptersChanged()
+				}
+			}
+
+		case "org.freedesktop.DBus.ObjectManager.InterfacesRemoved":
+			var ifaces []string
+			if len(sig.Body) == 2 && dbus.Store(sig.Body[1:], &ifaces) == nil {
+				for _, iface := range ifaces {
+					if iface == "org.bluez.Adapter1" {
+						btLog.Info("adapter removed", "path", sig.Body[0])
+						go adaptersChanged()
+					}
+				}
+			}
+
+		case "org.freedesktop.DBus.Properties.PropertiesChanged":
+			var iface string
+			var changed map[string]dbus.Variant
+			if len(sig.Body) < 2 || dbus.Store(sig.Body[:2], &iface, &changed) != nil {
+				continue
+			}
+
+			switch iface {
+			case "org.bluez.Adapter1":
+				go refreshAdapters()
+			case "org.bluez.Device1":
+				if connected, ok := changed["Connected"].Value().(bool); ok {
+					go deviceConnectionChanged(sig.Path, connected)
+				}
+			case "org.bluez.Battery1":
+				if level, ok := changed["Percentage"].Value().(byte); ok {
+					go batteryChanged(sig.Path, int(level))
+				}
+			}
+		}
+	}
+}
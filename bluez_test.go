@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestDbusInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		ifaces map[string]map[string]dbus.Variant
+		want   string
+	}{
+		{
+			"headset",
+			map[string]map[string]dbus.Variant{
+				"org.bluez.Device1": {
+					"Address":   dbus.MakeVariant("AA:BB:CC:DD:EE:FF"),
+					"Name":      dbus.MakeVariant("WH-1000XM4"),
+					"Alias":     dbus.MakeVariant("My headphones"),
+					"Class":     dbus.MakeVariant(uint32(0x240404)),
+					"Icon":      dbus.MakeVariant("audio-headset"),
+					"Paired":    dbus.MakeVariant(true),
+					"Trusted":   dbus.MakeVariant(true),
+					"Blocked":   dbus.MakeVariant(false),
+					"Connected": dbus.MakeVariant(true),
+					"UUIDs":     dbus.MakeVariant([]string{"0000110b-0000-1000-8000-00805f9b34fb", "0000111e-0000-1000-8000-00805f9b34fb", "0000fe2c-0000-1000-8000-00805f9b34fb"}),
+				},
+				"org.bluez.Battery1": {
+					"Percentage": dbus.MakeVariant(byte(72)),
+				},
+			},
+			"Device AA:BB:CC:DD:EE:FF\n" +
+				"\tName: WH-1000XM4\n" +
+				"\tAlias: My headphones\n" +
+				"\tClass: 0x00240404\n" +
+				"\tIcon: audio-headset\n" +
+				"\tPaired: yes\n" +
+				"\tTrusted: yes\n" +
+				"\tBlocked: no\n" +
+				"\tConnected: yes\n" +
+				"\tUUID: Audio Sink (0000110b-0000-1000-8000-00805f9b34fb)\n" +
+				"\tUUID: Handsfree (0000111e-0000-1000-8000-00805f9b34fb)\n" +
+				"\tUUID: Unknown (0000fe2c-0000-1000-8000-00805f9b34fb)\n" +
+				"\tBattery Percentage: 0x48 (72)\n",
+		},
+		{
+			"no class, icon nor uuids",
+			map[string]map[string]dbus.Variant{
+				"org.bluez.Device1": {
+					"Address": dbus.MakeVariant("11:22:33:44:55:66"),
+					"Alias":   dbus.MakeVariant("11-22-33-44-55-66"),
+					"Paired":  dbus.MakeVariant(true),
+				},
+			},
+			"Device 11:22:33:44:55:66\n" +
+				"\tName: \n" +
+				"\tAlias: 11-22-33-44-55-66\n" +
+				"\tPaired: yes\n" +
+				"\tTrusted: no\n" +
+				"\tBlocked: no\n" +
+				"\tConnected: no\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := dbusInfo(tt.ifaces); got != tt.want {
+			t.Errorf("%s: dbusInfo() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// the parsers written for bluetoothctl info read dbusInfo the same
+func TestDbusInfoParsers(t *testing.T) {
+	info := dbusInfo(map[string]map[string]dbus.Variant{
+		"org.bluez.Device1": {
+			"Address": dbus.MakeVariant("AA:BB:CC:DD:EE:FF"),
+			"Alias":   dbus.MakeVariant("Speaker"),
+			"Class":   dbus.MakeVariant(uint32(0x240414)),
+			"UUIDs":   dbus.MakeVariant([]string{"0000110b-0000-1000-8000-00805f9b34fb"}),
+		},
+		"org.bluez.Battery1": {
+			"Percentage": dbus.MakeVariant(byte(9)),
+		},
+	})
+
+	if got := parseBattery(info); got != 9 {
+		t.Errorf("parseBattery() = %d, want 9", got)
+	}
+	if got := audioProfiles(info); len(got) != 1 || got[0] != "A2DP" {
+		t.Errorf("audioProfiles() = %v, want [A2DP]", got)
+	}
+	if got := deviceGroup(info); got != "Speakers" {
+		t.Errorf("deviceGroup() = %q, want Speakers", got)
+	}
+	if m := aliasRe.FindStringSubmatch(info); m == nil || m[1] != "Speaker" {
+		t.Errorf("alias = %v, want Speaker", m)
+	}
+}
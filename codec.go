@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/systray"
+)
+
+// a2dp codecs offered in the menu, named as pipewire does
+var codecs = []struct{ id, title string }{
+	{"sbc", "SBC"},
+	{"sbc_xq", "SBC-XQ"},
+	{"aac", "AAC"},
+	{"aptx", "aptX"},
+	{"aptx_hd", "aptX HD"},
+	{"aptx_ll", "aptX LL"},
+	{"ldac", "LDAC"},
+	{"lc3", "LC3"},
+	{"faststream", "FastStream"},
+}
+
+// codecID maps a codec as reported by the audio server to the menu codecs, pulseaudio adds
+// quality suffixes, e.g. ldac_hq or sbc_xq_453
+func codecID(name string) string {
+	name = strings.ReplaceAll(strings.ToLower(name), "-", "_") // bluealsa says e.g. aptX-HD
+	id := ""
+	for _, c := range codecs {
+		if (name == c.id || strings.HasPrefix(name, c.id+"_")) && len(c.id) > len(id) {
+			id = c.id
+		}
+	}
+	return id
+}
+
+func codecTitle(name string) string {
+	for _, c := range codecs {
+		if c.id == name {
+			return c.title
+		}
+	}
+	if id := codecID(name); id != "" {
+		return codecTitle(id)
+	}
+	return strings.ToUpper(name)
+}
+
+// codecMessenger is implemented by backends switching codecs without per codec profiles,
+// pulseaudio and bluealsa
+type codecMessenger interface {
+	listCodecs(card audioCard) ([]string, error)
+	switchCodec(card audioCard, codec string) error
+}
+
+// codecSwitch is how to switch to a codec: a codec profile or a codec name for codecMessenger
+type codecSwitch struct {
+	card    audioCard
+	profile string
+	codec   string
+}
+
+// codecOptions lists the codecs the device can switch to, by codec id
+func codecOptions(mac string) map[string]codecSwitch {
+	options := make(map[string]codecSwitch)
+
+	card := findCard(mac, 1)
+	if card == nil {
+		return options
+	}
+
+	// pipewire has a profile per codec, e.g. a2dp-sink-ldac
+	for _, name := range card.profiles {
+		if id := codecID(strings.TrimPrefix(name, "a2dp-sink-")); strings.HasPrefix(name, "a2dp-sink-") && id != "" {
+			options[id] = codecSwitch{card: *card, profile: name}
+		}
+	}
+	if len(options) > 0 {
+		return options
+	}
+
+	messenger, ok := audio.(codecMessenger)
+	if !ok {
+		return options
+	}
+	list, err := messenger.listCodecs(*card)
+	if err != nil {
+		return options
+	}
+	for _, name := range list {
+		if id := codecID(name); id != "" {
+			options[id] = codecSwitch{card: *card, codec: name}
+		}
+	}
+	return options
+}
+
+func switchCodec(s codecSwitch) error {
+	if s.profile != "" {
+		return audio.setProfile(s.card, s.profile)
+	}
+	return audio.(codecMessenger).switchCodec(s.card, s.codec)
+}
+
+// restoreCodec switches to the codec remembered for the device, if it's not in use
+func (d *device) restoreCodec(options map[string]codecSwitch) {
+	id := deviceConf(d.mac).Codec
+	s, ok := options[id]
+	if id == "" || !ok || codecID(activeCodec(d.mac)) == id {
+		return
+	}
+
+	audioLog.Info("restoring codec", "device", d.name, "codec", id)
+	if err := switchCodec(s); err != nil {
+		audioLog.Error("failed to restore codec", "device", d.name, "codec", id, "err", err)
+	}
+}
+
+// addCodecUI fills the codec submenu, items are shown once the available codecs are known.
+// localMtx must be held.
+func (d *device) addCodecUI() {
+	d.codecItems = make(map[string]*systray.MenuItem)
+	for _, c := range codecs {
+		item := d.codecItem.AddSubMenuItemCheckbox(c.title, "Switch to "+c.title, false)
+		item.Hide()
+		d.codecItems[c.id] = item
+
+		go func(id string) {
+			for {
+				<-item.ClickedCh
+				d.selectCodec(id)
+			}
+		}(c.id)
+	}
+}
+
+// setCodecOptions shows the codecs the device can switch to. localMtx must be held.
+func (d *device) setCodecOptions(options map[string]codecSwitch) {
+	for id, item := range d.codecItems {
+		if _, ok := options[id]; ok && d.connected() {
+			item.Show()
+		} else {
+			item.Hide()
+		}
+	}
+}
+
+func (d *device) selectCodec(id string) {
+	s, ok := codecOptions(d.mac)[id]
+	if !ok {
+		reportError(fmt.Sprintf("codec %s is not available", codecTitle(id)))
+		return
+	}
+
+	if err := switchCodec(s); err != nil {
+		audioLog.Error("failed to switch codec", "device", d.name, "codec", id, "err", err)
+		reportError(fmt.Sprintf("failed to switch to %s: %s", codecTitle(id), err))
+		return
+	}
+	audioLog.Info("codec switched", "device", d.name, "codec", id)
+	updateConfig(d.mac, func(c *deviceConfig) { c.Codec = id })
+
+	// the sink is recreated with the new codec
+	codec := activeCodec(d.mac)
+	for i := 0; i < 10 && codecID(codec) != id; i++ {
+		time.Sleep(200 * time.Millisecond)
+		codec = activeCodec(d.mac)
+	}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+	d.setCodec(codec)
+}
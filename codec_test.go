@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestCodecID(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"sbc", "sbc"},
+		{"sbc_xq", "sbc_xq"},
+		{"sbc_xq_453", "sbc_xq"},
+		{"ldac_hq", "ldac"},
+		{"LDAC", "ldac"},
+		{"aptX", "aptx"},
+		{"aptX-HD", "aptx_hd"},
+		{"aptx_ll_duplex", "aptx_ll"},
+		{"faststream_duplex", "faststream"},
+		{"aptxhd", ""},
+		{"opus_05", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := codecID(tt.name); got != tt.want {
+			t.Errorf("codecID(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
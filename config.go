@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// per device settings, persisted across restarts
+type deviceConfig struct {
+	Adapter string `json:"adapter,omitempty"` // address of the adapter to connect through
+	Codec   string `json:"codec,omitempty"`   // a2dp codec, restored on connection
+	Volume  int    `json:"volume,omitempty"`  // percentage, restored on connection
+
+	Visibility string `json:"visibility,omitempty"` // show or hide, overriding the audio device filter
+
+	// menu entry
+	Alias    string `json:"alias,omitempty"`    // name shown by bluebao only
+	Pinned   bool   `json:"pinned,omitempty"`   // listed first
+	LastUsed int64  `json:"lastUsed,omitempty"` // unix time of the last connection
+
+	// auto-connect rules, see autoconnect.go
+	ConnectOnStartup   bool `json:"connectOnStartup,omitempty"`
+	ReconnectOnResume  bool `json:"reconnectOnResume,omitempty"`
+	ConnectWhenInRange bool `json:"connectWhenInRange,omitempty"`
+	KeepConnected      bool `json:"keepConnected,omitempty"` // reconnect after unexpected drops
+}
+
+type config struct {
+	Devices map[string]*deviceConfig `json:"devices"` // mac address // settings
+}
+
+var conf = config{Devices: make(map[string]*deviceConfig)}
+var confMtx sync.Mutex
+
+func configPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "bluebao", "config.json")
+}
+
+func loadConfig() {
+	confMtx.Lock()
+	defer confMtx.Unlock()
+
+	buf, err := os.ReadFile(configPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(buf, &conf)
+	}
+	if err != nil {
+		slog.Error("cant load config", "path", configPath(), "err", err)
+		return
+	}
+
+	if conf.Devices == nil {
+		conf.Devices = make(map[string]*deviceConfig)
+	}
+}
+
+// updateConfig applies fn to the settings of a device and saves the config
+func updateConfig(mac string, fn func(c *deviceConfig)) {
+	confMtx.Lock()
+	defer confMtx.Unlock()
+
+	c, ok := conf.Devices[mac]
+	if !ok {
+		c = &deviceConfig{}
+		conf.Devices[mac] = c
+	}
+	fn(c)
+
+	buf, err := json.MarshalIndent(conf, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(configPath()), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(configPath(), buf, 0o644)
+	}
+	if err != nil {
+		slog.Error("cant save config", "path", configPath(), "err", err)
+		reportError("cant save config: " + err.Error())
+	}
+}
+
+// deviceConf returns a copy of the settings of a device
+func deviceConf(mac string) deviceConfig {
+	confMtx.Lock()
+	defer confMtx.Unlock()
+
+	if c, ok := conf.Devices[mac]; ok {
+		return *c
+	}
+	return deviceConfig{}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const doctorTimeout = 5 * time.Second
+
+// dependency is a runtime requirement of bluebao, as found on this system
+type dependency struct {
+	name     string
+	ok       bool
+	detail   string // version when found, what's wrong otherwise
+	disables string // features lost without it
+	required bool   // bluebao is useless without it
+}
+
+// tool checks an external command, reading its version from the first line of versionArgs output
+func tool(logger *slog.Logger, name string, disables string, versionArgs ...string) dependency {
+	dep := dependency{name: name, disables: disables}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		dep.detail = "not found in PATH"
+		return dep
+	}
+
+	dep.ok = true
+	dep.detail = path
+	if len(versionArgs) == 0 {
+		return dep
+	}
+	if stdout, err := runCmdTimeout(logger, doctorTimeout, name, versionArgs...); err == nil {
+		if line, _, _ := strings.Cut(strings.TrimSpace(string(stdout)), "\n"); line != "" {
+			dep.detail = line
+		}
+	}
+	return dep
+}
+
+// service checks a dbus name is owned, i.e. the service is running
+func service(conn *dbus.Conn, connErr error, name string, busName string, disables string) dependency {
+	dep := dependency{name: name, disables: disables}
+	if connErr != nil {
+		dep.detail = "no bus: " + connErr.Error()
+		return dep
+	}
+
+	var running bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, busName).Store(&running); err != nil {
+		dep.detail = err.Error()
+		return dep
+	}
+	dep.ok = running
+	dep.detail = "running"
+	if !running {
+		dep.detail = busName + " not on the bus"
+	}
+	return dep
+}
+
+// socket checks an audio server socket in $XDG_RUNTIME_DIR
+func socket(name string, rel string, disables string) dependency {
+	path := filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), rel)
+	if _, err := os.Stat(path); err != nil {
+		return dependency{name: name, detail: "no socket at " + path, disables: disables}
+	}
+	return dependency{name: name, ok: true, detail: path, disables: disables}
+}
+
+// pactlJSON checks pactl speaks json (pactl 16+), bluebao parses nothing else
+func pactlJSON(logger *slog.Logger) dependency {
+	dep := dependency{name: "pactl -f json", disables: "pulse audio backend"}
+	if _, err := runCmdTimeout(logger, doctorTimeout, "pactl", "-f", "json", "info"); err == nil {
+		dep.ok = true
+		dep.detail = "supported"
+	} else if _, err := runCmdTimeout(logger, doctorTimeout, "pactl", "info"); err == nil {
+		dep.detail = "unsupported, pactl 16+ needed"
+	} else {
+		dep.detail = "no audio server answering: " + err.Error()
+	}
+	return dep
+}
+
+func checkDependencies(logger *slog.Logger) []dependency {
+	sys, sysErr := systemBus()
+	session, sessionErr := dbus.SessionBus()
+
+	systemDep := dependency{name: "system dbus", ok: sysErr == nil, detail: "connected", disables: "everything", required: true}
+	if sysErr != nil {
+		systemDep.detail = sysErr.Error()
+	}
+	sessionDep := dependency{name: "session dbus", ok: sessionErr == nil, detail: "connected", disables: "desktop notifications"}
+	if sessionErr != nil {
+		sessionDep.detail = sessionErr.Error()
+	}
+
+	bluetoothd := service(sys, sysErr, "bluetoothd", bluezService, "everything")
+	bluetoothd.required = true
+	bluetoothctl := tool(logger, "bluetoothctl", "connections, pairing", "--version")
+	bluetoothctl.required = true
+
+	deps := []dependency{
+		systemDep,
+		bluetoothd,
+		bluetoothctl,
+		tool(logger, "pactl", "pulse audio backend", "--version"),
+	}
+	if deps[len(deps)-1].ok {
+		deps = append(deps, pactlJSON(logger))
+	}
+	deps = append(deps,
+		socket("pulse socket", "pulse/native", "pulse audio backend"),
+		tool(logger, "wpctl", "pipewire audio backend"),
+		tool(logger, "pw-dump", "pipewire audio backend", "--version"),
+		socket("pipewire socket", "pipewire-0", "pipewire audio backend"),
+		service(sys, sysErr, "bluealsa", bluealsaService, "bluealsa audio backend"),
+		tool(logger, "ip", "network feature", "-V"),
+		tool(logger, "zenity", "renaming devices", "--version"),
+		service(sys, sysErr, "logind", "org.freedesktop.login1", "reconnecting after resume"),
+		sessionDep,
+		service(session, sessionErr, "notifications", "org.freedesktop.Notifications", "desktop notifications"),
+	)
+
+	if _, err := os.Stat("/dev/rfkill"); err != nil {
+		deps = append(deps, dependency{name: "rfkill", detail: err.Error(), disables: "rfkill block detection"})
+	} else {
+		deps = append(deps, dependency{name: "rfkill", ok: true, detail: "/dev/rfkill"})
+	}
+
+	audioDep := dependency{name: "audio backend", required: true, disables: "audio profiles, default output, codecs, volume"}
+	backend, problem := pickAudio()
+	audioDep.ok = problem == ""
+	audioDep.detail = backend.name()
+	if problem != "" {
+		audioDep.detail = problem
+	}
+	return append(deps, audioDep)
+}
+
+// doctor prints the dependencies, for `bluebao doctor`. Returns the exit code.
+func doctor() int {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if *verbose {
+		logger = slog.Default()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	code := 0
+	for _, dep := range checkDependencies(logger) {
+		status := "ok"
+		lost := ""
+		if !dep.ok {
+			status = "missing"
+			lost = "disables: " + dep.disables
+			if dep.required {
+				status = "MISSING"
+				code = 1
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dep.name, status, dep.detail, lost)
+	}
+	w.Flush()
+	return code
+}
+
+// startupCheck logs what's missing, flagging the tray if bluebao can't work
+func startupCheck() {
+	for _, dep := range checkDependencies(slog.Default()) {
+		switch {
+		case dep.ok:
+			slog.Debug("dependency found", "name", dep.name, "detail", dep.detail)
+		case dep.required:
+			slog.Error("missing dependency", "name", dep.name, "detail", dep.detail, "disables", dep.disables)
+			if dep.name != "audio backend" { // flagged by setupAudio
+				setProblem(dep.name, dep.name+" missing: "+dep.detail)
+			}
+		default:
+			slog.Warn("missing dependency", "name", dep.name, "detail", dep.detail, "disables", dep.disables)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/systray"
+)
+
+var showAll = flag.Bool("sa", false, "show all paired devices, not only audio ones")
+
+// service uuids of the audio profiles
+var audioUUIDs = map[string]string{
+	"0000110b-0000-1000-8000-00805f9b34fb": "A2DP",     // audio sink
+	"0000110d-0000-1000-8000-00805f9b34fb": "A2DP",     // advanced audio distribution
+	"00001108-0000-1000-8000-00805f9b34fb": "HSP",      // headset
+	"00001131-0000-1000-8000-00805f9b34fb": "HSP",      // headset HS
+	"0000111e-0000-1000-8000-00805f9b34fb": "HFP",      // handsfree
+	"0000184e-0000-1000-8000-00805f9b34fb": "LE Audio", // audio stream control
+	"00001850-0000-1000-8000-00805f9b34fb": "LE Audio", // published audio capabilities
+	"00001853-0000-1000-8000-00805f9b34fb": "LE Audio", // common audio
+	"00001854-0000-1000-8000-00805f9b34fb": "LE Audio", // hearing access
+}
+
+// from bluetoothctl info, e.g. "UUID: Audio Sink (0000110b-0000-1000-8000-00805f9b34fb)"
+var (
+	uuidRe  = regexp.MustCompile(`UUID: .*\(([0-9a-fA-F-]{36})\)`)
+	classRe = regexp.MustCompile(`Class: 0x([0-9a-fA-F]+)`)
+	iconRe  = regexp.MustCompile(`Icon: (\S+)`)
+)
+
+// class of device: major class audio/video, or the audio service bit
+const (
+	classMajorMask  = 0x1f00
+	classMajorAudio = 0x0400
+	classAudioBit   = 0x200000
+)
+
+// audioProfiles lists the audio profiles of a device from its service uuids. Devices not
+// listing their uuids, e.g. before pairing, are told by their class of device or icon.
+func audioProfiles(info string) []string {
+	profiles := make([]string, 0)
+	seen := make(map[string]bool)
+	uuids := uuidRe.FindAllStringSubmatch(info, -1)
+	for _, m := range uuids {
+		if p, ok := audioUUIDs[strings.ToLower(m[1])]; ok && !seen[p] {
+			seen[p] = true
+			profiles = append(profiles, p)
+		}
+	}
+	if len(uuids) > 0 {
+		return profiles
+	}
+
+	if m := classRe.FindStringSubmatch(info); m != nil {
+		if class, err := strconv.ParseUint(m[1], 16, 32); err == nil && (class&classMajorMask == classMajorAudio || class&classAudioBit != 0) {
+			return []string{"audio class"}
+		}
+	}
+	if m := iconRe.FindStringSubmatch(info); m != nil && strings.HasPrefix(m[1], "audio-") {
+		return []string{"audio icon"}
+	}
+	return profiles
+}
+
+func isAudioDevice(info string) bool {
+	return len(audioProfiles(info)) > 0
+}
+
+// visible tells if a paired device goes in the menu, the user's choice wins over the filter
+func visible(mac string, info string) bool {
+	switch deviceConf(mac).Visibility {
+	case "show":
+		return true
+	case "hide":
+		return false
+	}
+	return *showAll || isAudioDevice(info)
+}
+
+// paired devices filtered out of the menu
+type otherDevice struct {
+	item *systray.MenuItem
+	name string
+	info string
+}
+
+var otherMenu *systray.MenuItem
+var others = make(map[string]*otherDevice) // mac address // device
+
+func addOtherDevicesUI() {
+	otherMenu = systray.AddMenuItem("Other devices", "Paired devices hidden from the menu, click to show")
+	otherMenu.Hide()
+}
+
+// addOtherDevice lists a device filtered out of the menu, clicking shows it. localMtx must be held.
+func addOtherDevice(mac string, name string, info string) {
+	btLog.Debug("device hidden", "device", name, "mac", mac, "profiles", audioProfiles(info))
+	otherMenu.Show()
+	if o, ok := others[mac]; ok {
+		o.name, o.info = name, info
+		o.item.SetTitle(name)
+		o.item.Show()
+		return
+	}
+
+	o := &otherDevice{item: otherMenu.AddSubMenuItem(name, "Show "+name+" in the menu"), name: name, info: info}
+	others[mac] = o
+
+	go func() {
+		for {
+			<-o.item.ClickedCh
+			updateConfig(mac, func(c *deviceConfig) { c.Visibility = "show" })
+			objs, _ := bluezManagedObjects()
+
+			localMtx.Lock()
+			o.item.Hide()
+			if _, ok := localEndpoints[mac]; !ok {
+				addDevice(mac, o.name, o.info, objs)
+			}
+			localMtx.Unlock()
+		}
+	}()
+}
+
+// hide queues moving the device to the other devices, disconnecting first, see connect.
+// localMtx must be held.
+func (d *device) hide() <-chan struct{} {
+	if d.state == stateConnecting {
+		d.cancelConnect()
+	}
+	return d.queue(op{kind: opHide, done: make(chan struct{})})
+}
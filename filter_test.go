@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAudioProfiles(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		want []string
+	}{
+		{"a2dp and hfp", "UUID: Audio Sink (0000110b-0000-1000-8000-00805f9b34fb)\n\tUUID: Handsfree (0000111e-0000-1000-8000-00805f9b34fb)", []string{"A2DP", "HFP"}},
+		{"deduplicated", "UUID: Audio Sink (0000110b-0000-1000-8000-00805f9b34fb)\n\tUUID: Advanced Audio Distribu.. (0000110D-0000-1000-8000-00805F9B34FB)", []string{"A2DP"}},
+		{"le audio", "UUID: Published Audio Capabil.. (00001850-0000-1000-8000-00805f9b34fb)", []string{"LE Audio"}},
+		{"uuids win over the class", "Class: 0x00240418\n\tUUID: Headset (00001108-0000-1000-8000-00805f9b34fb)", []string{"HSP"}},
+		{"audio major class", "Class: 0x00240418", []string{"audio class"}},
+		{"audio service bit", "Class: 0x007a020c", []string{"audio class"}},
+		{"phone", "Class: 0x005a020c", []string{}},
+		{"phone listing its uuids", "Class: 0x007a020c\n\tIcon: phone\n\tUUID: Audio Source (0000110a-0000-1000-8000-00805f9b34fb)\n\tUUID: Handsfree Audio Gateway (0000111f-0000-1000-8000-00805f9b34fb)", []string{}},
+		{"audio icon", "Icon: audio-headset", []string{"audio icon"}},
+		{"keyboard", "Class: 0x00000540\n\tIcon: input-keyboard\n\tUUID: Human Interface Device... (00001124-0000-1000-8000-00805f9b34fb)", []string{}},
+		{"nothing", "", []string{}},
+	}
+	for _, tt := range tests {
+		if got := audioProfiles(tt.info); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: audioProfiles() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceGroup(t *testing.T) {
+	tests := []struct {
+		info string
+		want string
+	}{
+		{"Class: 0x00240404", "Headphones"}, // wearable headset
+		{"Class: 0x00240408", "Headphones"}, // hands-free
+		{"Class: 0x00240418", "Headphones"}, // headphones
+		{"Class: 0x00240414", "Speakers"},   // loudspeaker
+		{"Class: 0x0024041c", "Speakers"},   // portable audio
+		{"Class: 0x00240428", "Speakers"},   // hifi audio
+		{"Class: 0x00200420", "Car"},
+		{"Class: 0x00240410", "Other"}, // microphone
+		{"Class: 0x005a020c", "Other"}, // phone
+		{"Class: 0x005a020c\n\tIcon: audio-headset", "Headphones"},
+		{"Icon: audio-headphones", "Headphones"},
+		{"Icon: audio-card", "Speakers"},
+		{"Icon: input-keyboard", "Other"},
+		{"", "Other"},
+	}
+	for _, tt := range tests {
+		if got := deviceGroup(tt.info); got != tt.want {
+			t.Errorf("deviceGroup(%q) = %q, want %q", tt.info, got, tt.want)
+		}
+	}
+}
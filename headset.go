@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+)
+
+var autoHeadset = flag.Bool("ah", false, "switch to the headset profile while an application records")
+var autoHeadsetApps = flag.String("aa", "", "applications switching to the headset profile, comma separated, all if empty")
+
+// recordings briefly vanish while the profile switches, or between two calls
+const recordingGrace = 3 * time.Second
+
+var (
+	headsetRevert string // profile to go back to once bluebao switched to headset, e.g. a2dp-sink-ldac
+	headsetMac    string // device headsetRevert belongs to
+	headsetMtx    sync.Mutex
+)
+
+// watchRecording follows the recording streams to switch the connected device to the
+// headset profile while one is open
+func watchRecording() {
+	if !*autoHeadset {
+		return
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		for range changed {
+			syncHeadsetProfile()
+		}
+	}()
+
+	for {
+		err := audio.watchRecordings(changed)
+		if errors.Is(err, errUnsupported) {
+			audioLog.Warn("cant switch to the headset profile automatically", "backend", audio.name(), "err", err)
+			return
+		}
+		audioLog.Warn("stopped watching recordings, restarting", "err", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func recording() bool {
+	streams, err := audio.recordings()
+	if err != nil {
+		return false
+	}
+	for _, s := range streams {
+		if *autoHeadsetApps == "" || s.matches(*autoHeadsetApps) {
+			return true
+		}
+	}
+	return false
+}
+
+func syncHeadsetProfile() {
+	id := connectedMac()
+
+	headsetMtx.Lock()
+	defer headsetMtx.Unlock()
+
+	if id == "" || id != headsetMac {
+		headsetRevert = ""
+	}
+	if id == "" {
+		return
+	}
+
+	if recording() {
+		// leave it alone if the user picked a profile already
+		if profile := activeProfile(id); headsetRevert == "" && strings.HasPrefix(profile, "a2dp") {
+			audioLog.Info("recording started, switching to the headset profile", "from", profile)
+			headsetRevert, headsetMac = profile, id
+			setProfile(id, "headset-head-unit")
+		}
+		return
+	}
+
+	if headsetRevert != "" {
+		time.Sleep(recordingGrace)
+		if recording() {
+			return
+		}
+		audioLog.Info("recording stopped, switching back to high quality", "profile", headsetRevert)
+		profile := headsetRevert
+		headsetRevert = ""
+		setProfile(id, profile)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var verbose = flag.Bool("v", false, "verbose logging")
+var logFile = flag.Bool("l", false, "also log to $XDG_STATE_HOME/bluebao/bluebao.log")
+var cmdTimeout = flag.Duration("ct", 20*time.Second, "timeout for external commands and dbus calls")
+
+// per component loggers, set up by setupLogging
+var (
+	btLog    = slog.Default()
+	audioLog = slog.Default()
+	netLog   = slog.Default()
+	uiLog    = slog.Default()
+)
+
+func stateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "bluebao")
+}
+
+func setupLogging() {
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+
+	var out io.Writer = os.Stderr
+	var fileErr error
+	if *logFile {
+		f, err := openLogFile()
+		if err == nil {
+			out = io.MultiWriter(os.Stderr, f)
+		}
+		fileErr = err
+	}
+
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	btLog = logger.With("component", "bt")
+	audioLog = logger.With("component", "audio")
+	netLog = logger.With("component", "net")
+	uiLog = logger.With("component", "ui")
+
+	if fileErr != nil {
+		slog.Error("cant open log file", "err", fileErr)
+	}
+}
+
+func openLogFile() (*os.File, error) {
+	dir := stateDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dir, "bluebao.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// runCmd runs an external command, logging its duration and exit status
+func runCmd(logger *slog.Logger, name string, arg ...string) ([]byte, error) {
+	return runCmdContext(context.Background(), logger, *cmdTimeout, name, arg...)
+}
+
+// runCmdTimeout is runCmd for commands expected to take longer than usual, e.g. dialogs
+func runCmdTimeout(logger *slog.Logger, timeout time.Duration, name string, arg ...string) ([]byte, error) {
+	return runCmdContext(context.Background(), logger, timeout, name, arg...)
+}
+
+// runCmdContext is runCmd for commands that can be cancelled
+func runCmdContext(parent context.Context, logger *slog.Logger, timeout time.Duration, name string, arg ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	start := time.Now()
+	stdout, err := exec.CommandContext(ctx, name, arg...).Output()
+	if parent.Err() != nil {
+		err = fmt.Errorf("%s cancelled", name)
+	} else if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s timed out after %s", name, timeout)
+	}
+
+	status := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		status = -1
+	}
+
+	attrs := []any{"cmd", name + " " + strings.Join(arg, " "), "duration", time.Since(start), "status", status}
+	if err != nil {
+		logger.Warn("command failed", append(attrs, "err", err, "stdout", strings.TrimSpace(string(stdout)))...)
+	} else {
+		logger.Debug("command", append(attrs, "stdout", strings.TrimSpace(string(stdout)))...)
+	}
+
+	return stdout, err
+}
@@ -1,148 +1,218 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/getlantern/systray"
+	"github.com/godbus/dbus/v5"
 )
 
-// mac address // menu
-var localEndpoints = make(map[string]*systray.MenuItem)
+type device struct {
+	name    string
+	mac     string
+	adapter dbus.ObjectPath // "" if adapters are unknown, bluetoothctl is used then
+
+	menu         *systray.MenuItem
+	connectItem  *systray.MenuItem
+	batteryItem  *systray.MenuItem
+	codecItem    *systray.MenuItem
+	codecItems   map[string]*systray.MenuItem // codec id // menu
+	volumeItem   *systray.MenuItem
+	peerMenu     *systray.MenuItem
+	peerItems    map[string]*systray.MenuItem // peer hostname // menu
+	adapterMenu  *systray.MenuItem
+	adapterItems map[string]*systray.MenuItem // adapter address // menu
+	trustItem    *systray.MenuItem
+	blockItem    *systray.MenuItem
+
+	battery      int    // percentage, -1 if unknown
+	codec        string // active codec, "" if unknown
+	volume       int    // percentage, -1 if unknown
+	err          string // last failure, cleared on success
+	reconnect    string // reconnection status, "" if not reconnecting
+	reconnectGen int    // bumped to cancel a reconnection
+
+	state         deviceState
+	ops           chan op            // processed by worker
+	cancelConnect context.CancelFunc // cancels the connection in progress
+	removed       bool               // forgotten, hidden or out of adapters, ops is closed
+	dropExpected  bool               // blocked or adapter powered off, the disconnection isn't a loss
+	quiet         bool               // the connection in progress is automatic, not shown
+	away          bool               // not seen since startup or last seen out of range, see watchInRange
+}
+
+// mac address // device
+var localEndpoints = make(map[string]*device)
 var localMtx sync.Mutex
 
 var hostname, _ = os.Hostname()
 var serverPort = flag.String("sp", "8829", "server port")
+var connectRetries = flag.Int("cr", 2, "connection retries")
 var enableNetwork = flag.Bool("d", false, "disable network feature")
 
-func addUIEntry(name string, mac string) *systray.MenuItem {
-	m := systray.AddMenuItemCheckbox(name, name, false)
-
-	go func() {
-		for {
-			<-m.ClickedCh
-			localMtx.Lock()
+func (d *device) refreshLabel() {
+	title := d.name
+	if d.battery >= 0 {
+		title = fmt.Sprintf("%s — %d%%", d.name, d.battery)
+	}
 
-			if m.Checked() {
-				disconnect(mac, m)
-			} else {
-				connect(mac, m)
-			}
+	tooltip := title
+	if d.reconnect != "" {
+		title = "↻ " + title
+		tooltip = d.reconnect
+	}
+	if d.err != "" {
+		title = "⚠ " + title
+		tooltip = d.err
+	}
 
-			localMtx.Unlock()
-		}
-	}()
+	switch {
+	case d.state == stateConnecting && !d.quiet:
+		title += " — connecting…"
+		d.connectItem.SetTitle("Cancel connecting")
+	case d.state == stateDisconnecting:
+		title += " — disconnecting…"
+		d.connectItem.SetTitle("Disconnecting…")
+	case d.state == stateConnected:
+		d.connectItem.SetTitle("Disconnect")
+	default:
+		d.connectItem.SetTitle("Connect")
+	}
 
-	return m
-}
+	d.menu.SetTitle(title)
+	d.menu.SetTooltip(tooltip)
 
-func disconnect(mac string, m *systray.MenuItem) {
-	go setDefaultAudio("Headphones")
-	if btOptOutOk("disconnect", mac) {
-		m.Uncheck()
+	if d.battery >= 0 {
+		d.batteryItem.SetTitle(fmt.Sprintf("Battery: %d%%", d.battery))
+		d.batteryItem.Show()
+	} else {
+		d.batteryItem.Hide()
 	}
-}
 
-func connect(mac string, m *systray.MenuItem) {
-	m.Disable()
-	pushNetwork(hostname + "," + mac)
+	if d.volume >= 0 {
+		d.volumeItem.SetTitle(fmt.Sprintf("Volume: %d%%", d.volume))
+		d.volumeItem.Show()
+	} else {
+		d.volumeItem.Hide()
+	}
 
-	// only 1 audio device allowed at the same time, disconnect others
-	for macaddr, menu := range localEndpoints {
-		if menu.Checked() {
-			disconnect(macaddr, menu)
+	if d.codec != "" {
+		d.codecItem.SetTitle("Codec: " + codecTitle(d.codec))
+		d.codecItem.Show()
+		for id, item := range d.codecItems {
+			if id == codecID(d.codec) {
+				item.Check()
+			} else {
+				item.Uncheck()
+			}
 		}
+	} else {
+		d.codecItem.Hide()
 	}
+}
 
-	// allow for network propagation
-	time.Sleep(200 * time.Millisecond)
-
-	if btOptOutOk("connect", mac) {
-		m.Check()
-		go setDefaultAudio("bluez")
+// setCodec records the codec in use once the audio device is up. localMtx must be held.
+func (d *device) setCodec(codec string) {
+	if d.state != stateConnected {
+		return // disconnected meanwhile
 	}
-
-	m.Enable()
+	d.codec = codec
+	d.refreshLabel()
+	setTrayConnected(d.name, codecTitle(codec))
 }
 
-func btOptOut(arg ...string) (string, error) {
-	cmd := exec.Command("bluetoothctl", arg...)
-	stdout, err := cmd.Output()
-	fmt.Println("> bluetoothctl", arg)
-	fmt.Println("<", string(stdout), err)
-	return string(stdout), err
+// audioID is how the mac address appears in bluez object paths, e.g. dev_AA_BB_CC_DD_EE_FF
+func (d *device) audioID() string {
+	return strings.ReplaceAll(d.mac, ":", "_")
 }
 
-func btOptOutOk(arg ...string) bool {
-	_, err := btOptOut(arg...)
-	return err == nil
+// setError marks the device menu entry as failed and surfaces the error on the tray
+func (d *device) setError(msg string) {
+	d.err = msg
+	d.refreshLabel()
+	reportError(msg)
 }
 
-func find(input string, entryType string) *string {
-	type output struct {
-		Name string `json:"name"`
-		// other fields are ignored
-	}
+func (d *device) addUIEntry() {
+	m := systray.AddMenuItemCheckbox(d.name, d.name, false)
+	d.menu = m
+	// trays showing a submenu don't report clicks on its parent, so connect is in there too
+	d.connectItem = m.AddSubMenuItem("Connect", "Connect/disconnect")
+	defaultItem := m.AddSubMenuItem("Set as default output", "Use this device as default audio output")
+	profile := m.AddSubMenuItem("Audio profile", "Audio profile")
+	menuHq := profile.AddSubMenuItem("High Quality", "High Quality")
+	menuHeadset := profile.AddSubMenuItem("Headset + Microphone", "Headset + Microphone")
+	d.peerMenu = m.AddSubMenuItem("Send to peer", "Hand the device over to another bluebao instance")
+	d.peerMenu.Hide()
+	d.peerItems = make(map[string]*systray.MenuItem)
+	d.adapterMenu = m.AddSubMenuItem("Adapter", "Adapter to connect through")
+	d.adapterMenu.Hide()
+	d.adapterItems = make(map[string]*systray.MenuItem)
+	d.batteryItem = m.AddSubMenuItem("", "Battery level")
+	d.batteryItem.Disable()
+	d.codecItem = m.AddSubMenuItem("", "Active codec")
+	d.addCodecUI()
+	d.addVolumeUI()
 
-	for i := 0; i < 20; i++ {
-		c := exec.Command("pactl", "-f", "json", "list", "short", entryType)
-		stdout, _ := c.Output()
-		var out []output
-		if err := json.Unmarshal(stdout, &out); err != nil {
-			log.Printf("Error parsing JSON: %v\n", err)
-			continue
+	go func() {
+		for {
+			<-defaultItem.ClickedCh
+			setDefaultAudio(d.mac)
+		}
+	}()
+	go func() {
+		for {
+			<-menuHq.ClickedCh
+			setProfile(d.mac, "a2dp-sink")
+		}
+	}()
+	go func() {
+		for {
+			<-menuHeadset.ClickedCh
+			setProfile(d.mac, "headset-head-unit")
 		}
+	}()
 
-		for _, s := range out {
-			if strings.Contains(s.Name, input) {
-				return &s.Name
+	go func() {
+		for {
+			select {
+			case <-m.ClickedCh:
+			case <-d.connectItem.ClickedCh:
 			}
+			d.clicked()
 		}
+	}()
+}
 
-		time.Sleep(200 * time.Millisecond)
-		continue // retry
-	}
-
-	log.Printf("Failed to find %s\n", input)
-	return nil
+func btOptOut(arg ...string) (string, error) {
+	return btOptOutContext(context.Background(), arg...)
 }
 
-func setDefaultAudio(input string) {
-	fmt.Println("trying to set default audio to", input)
-	sink := find(input, "sinks")
-	if sink == nil {
-		return
-	}
+func btOptOutContext(ctx context.Context, arg ...string) (string, error) {
+	stdout, err := runCmdContext(ctx, btLog, *cmdTimeout, "bluetoothctl", arg...)
+	return string(stdout), err
+}
 
-	fmt.Println("~~ setting default audio to", sink)
-	cmd := exec.Command("pactl", "set-default-sink", *sink)
-	_, err := cmd.Output()
-	if err != nil {
-		fmt.Println("failed to set default bt audio", err)
-	} else {
-		fmt.Println("~~ default audio set to", sink)
+// btFailure extracts a human readable reason from a failed bluetoothctl call
+func btFailure(output string, err error) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
 	}
+	return err.Error()
 }
 
-func setProfile(profile string) {
-	card := find("bluez", "cards")
-	if card == nil {
-		return
-	}
-	cmd := exec.Command("pactl", "set-card-profile", *card, profile)
-	_, err := cmd.Output()
-	if err != nil {
-		fmt.Println("failed to set audio profile", err)
-	}
+func btOptOutOk(arg ...string) bool {
+	_, err := btOptOut(arg...)
+	return err == nil
 }
 
 func startServer() {
@@ -152,7 +222,9 @@ func startServer() {
 
 	pc, err := net.ListenPacket("udp4", ":"+*serverPort)
 	if err != nil {
-		panic(err)
+		netLog.Error("cant start server", "err", err)
+		setProblem("network", "network server failed: "+err.Error())
+		return
 	}
 	defer pc.Close()
 
@@ -160,22 +232,36 @@ func startServer() {
 		buf := make([]byte, 9000)
 		n, _, err := pc.ReadFrom(buf)
 		if err != nil {
-			fmt.Println("err reading server", err)
+			netLog.Error("err reading server", "err", err)
+			continue
 		}
 
 		req := strings.SplitN(string(buf[:n]), ",", 2)
+		if len(req) != 2 {
+			netLog.Warn("malformed query", "query", string(buf[:n]))
+			continue
+		}
 		requester, queriedMac := req[0], req[1]
 
 		if requester == hostname {
 			continue
 		}
 
-		// fmt.Println("~~ receiving query", req) //, string(buf[:n]))
+		if handlePeerMessage(requester, queriedMac) {
+			continue
+		}
+
+		netLog.Debug("receiving query", "requester", requester, "mac", queriedMac)
 
 		localMtx.Lock()
-		m, ok := localEndpoints[queriedMac]
-		if ok && m.Checked() {
-			disconnect(queriedMac, m) // someone wants to take over that device, we drop it
+		d, ok := localEndpoints[queriedMac]
+		if ok && d.connected() {
+			// someone wants to take over that device, we drop it
+			done := d.disconnect()
+			go func(name string) {
+				<-done
+				notify(notifyTakeover, "Device taken over", fmt.Sprintf("%s was taken over by %s", name, requester))
+			}(d.name)
 		}
 		localMtx.Unlock()
 	}
@@ -187,10 +273,12 @@ func pushNetwork(payload string) {
 	}
 
 	for _, ip := range getBroadcasts() {
-		fmt.Println("~~ broadcasting", payload)
+		netLog.Debug("broadcasting", "payload", payload, "ip", ip)
 		conn, err := net.Dial("udp4", ip+":"+*serverPort)
 		if err != nil {
-			fmt.Println("failed nw push", err)
+			netLog.Error("failed nw push", "err", err)
+			reportError("failed to notify peers: " + err.Error())
+			continue
 		}
 
 		conn.Write([]byte(payload))
@@ -204,10 +292,19 @@ func startUI(uiReady chan bool) {
 		systray.SetTitle("")
 		systray.SetTooltip("")
 
+		statusMtx.Lock()
+		statusItem = systray.AddMenuItem("", "")
+		statusItem.Disable()
+		statusMtx.Unlock()
+		refreshTray()
+
 		menuQuit := systray.AddMenuItem("Quit", "Quit")
 		audioProfile := systray.AddMenuItem("Audio profile", "Audio profile")
 		menuHq := audioProfile.AddSubMenuItem("High Quality", "High Quality")
 		menuHeadset := audioProfile.AddSubMenuItem("Headset + Microphone", "Headset + Microphone")
+		addPairingUI()
+		addAdaptersUI()
+		addOtherDevicesUI()
 
 		systray.AddSeparator()
 
@@ -221,13 +318,13 @@ func startUI(uiReady chan bool) {
 		go func() {
 			for {
 				<-menuHq.ClickedCh
-				setProfile("a2dp-sink")
+				setConnectedProfile("a2dp-sink")
 			}
 		}()
 		go func() {
 			for {
 				<-menuHeadset.ClickedCh
-				setProfile("headset-head-unit")
+				setConnectedProfile("headset-head-unit")
 			}
 		}()
 
@@ -238,34 +335,126 @@ func startUI(uiReady chan bool) {
 }
 
 func scanPairedDevices() {
-	fmt.Println("~~ scanning for avaiable devices")
+	btLog.Info("scanning for available devices")
 
-	output, _ := btOptOut("devices")
+	output, err := btOptOut("devices")
+	if err != nil {
+		setProblem("devices", "cant list devices: "+btFailure(output, err))
+		return
+	}
+	clearProblem("devices")
 	devices := strings.Split(output, "\n")
 
+	// bluetoothctl info can be slow, only take the lock to add the devices
 	localMtx.Lock()
-	defer localMtx.Unlock()
+	known := make(map[string]bool)
+	for mac := range localEndpoints {
+		known[mac] = true
+	}
+	localMtx.Unlock()
 
-	for _, device := range devices[:len(devices)-1] {
-		infos := strings.SplitN(device, " ", 3)
+	found := make([]pairedDevice, 0)
+	for _, line := range devices[:len(devices)-1] {
+		infos := strings.SplitN(line, " ", 3)
+		if len(infos) != 3 {
+			continue
+		}
 		mac, name := infos[1], infos[2]
+		if known[mac] {
+			continue
+		}
+		known[mac] = true
 
-		output, _ := btOptOut("info", mac)
-		connected := strings.Contains(output, "Connected: yes")
-		if strings.Contains(output, "Audio") {
-			localEndpoints[mac] = addUIEntry(name, mac)
-			if connected {
-				localEndpoints[mac].Check()
-			}
+		output, err := btOptOut("info", mac)
+		if err != nil {
+			reportError("cant get info for " + name + ": " + btFailure(output, err))
+			continue
 		}
+		found = append(found, pairedDevice{mac, name, output})
 	}
+
+	// devices only paired with other adapters are invisible to bluetoothctl
+	objs, _ := bluezManagedObjects()
+	for _, ifaces := range objs {
+		dev, ok := ifaces["org.bluez.Device1"]
+		if !ok {
+			continue
+		}
+		mac, _ := dev["Address"].Value().(string)
+		name, _ := dev["Alias"].Value().(string)
+		paired, _ := dev["Paired"].Value().(bool)
+		if known[mac] || !paired {
+			continue
+		}
+		known[mac] = true
+		found = append(found, pairedDevice{mac, name, dbusInfo(ifaces)})
+	}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	devs := make([]pairedDevice, 0)
+	for _, dev := range found {
+		if _, ok := localEndpoints[dev.mac]; ok {
+			continue // added meanwhile, e.g. by a pairing
+		}
+		if visible(dev.mac, dev.info) {
+			devs = append(devs, dev)
+		} else {
+			addOtherDevice(dev.mac, dev.name, dev.info)
+		}
+	}
+	addDevices(devs, objs)
+}
+
+// addDevice adds a menu entry for a paired device, info being the output of bluetoothctl info
+// and objs the bluez objects, nil without dbus. localMtx must be held.
+func addDevice(mac string, name string, info string, objs bluezObjects) *device {
+	name = displayName(mac, name)
+	d := &device{name: name, mac: mac, battery: -1, volume: -1, away: true, ops: make(chan op, 16)}
+	go d.worker()
+	d.addUIEntry()
+	d.addAutoConnectUI()
+	d.addManageUI(info)
+	d.addPeerItems()
+	d.resolveAdapter(objs)
+	localEndpoints[mac] = d
+
+	if strings.Contains(info, "Connected: yes") {
+		d.state = stateConnected
+		d.menu.Check()
+		updateBattery(d, info)
+		setTrayConnected(name, "")
+		go func() {
+			codec := activeCodec(d.mac)
+			options := codecOptions(d.mac)
+			volume := -1
+			if sink := d.sink(1); sink != nil {
+				volume = sinkVolume(*sink)
+			}
+
+			localMtx.Lock()
+			defer localMtx.Unlock()
+			d.setCodec(codec)
+			d.setCodecOptions(options)
+			if d.connected() {
+				d.volume = volume
+				d.refreshLabel()
+			}
+		}()
+	}
+
+	// hides the battery and codec entries of idle devices
+	d.refreshLabel()
+	return d
 }
 
 func getBroadcasts() []string {
-	cmd := exec.Command("ip", "addr", "show")
-	stdout, err := cmd.Output()
+	stdout, err := runCmd(netLog, "ip", "addr", "show")
 	if err != nil {
-		fmt.Println("cant determine broadcast IPs")
+		netLog.Error("cant determine broadcast IPs", "err", err)
+		reportError("cant determine broadcast IPs: " + err.Error())
+		return nil
 	}
 
 	ips := make([]string, 0)
@@ -284,18 +473,40 @@ func main() {
 	flag.Usage = func() {
 		fmt.Println("🥟 bluebao\nA simple bluetooth audio devices manager to easily manage multiple devices.")
 		fmt.Println()
+		fmt.Println("usage: bluebao [flags]         run in the tray")
+		fmt.Println("       bluebao [flags] doctor  check the runtime dependencies")
+		fmt.Println()
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
-	fmt.Println("~~ bluebao starting")
-	btOptOut("power", "on")
+	setupLogging()
+	if flag.Arg(0) == "doctor" {
+		os.Exit(doctor())
+	}
+
+	loadConfig()
+	slog.Info("bluebao starting")
 
 	uiReady := make(chan bool)
 	go startUI(uiReady)
 	<-uiReady
+	go startupCheck()
+
+	loadRfkill()
+	refreshAdapters()
+	powerOn()
+	go watchRfkill()
+
+	setupAudio()
 	go startServer()
+	go announce()
 	scanPairedDevices()
+	go watchBluez()
+	go watchSleep()
+	go connectOnStartup()
+	go watchInRange()
+	go watchRecording()
 
 	select {}
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/getlantern/systray"
+)
+
+// addManageUI adds the management actions to the device submenu, info being the output of bluetoothctl info
+func (d *device) addManageUI(info string) {
+	d.trustItem = d.menu.AddSubMenuItemCheckbox("Trusted", "Allow the device to connect without confirmation", strings.Contains(info, "Trusted: yes"))
+	d.blockItem = d.menu.AddSubMenuItemCheckbox("Blocked", "Refuse any connection from the device", strings.Contains(info, "Blocked: yes"))
+	renameItem := d.menu.AddSubMenuItem("Rename…", "Set the device alias")
+	aliasItem := d.menu.AddSubMenuItem("Alias…", "Name shown by bluebao only")
+	pinItem := d.menu.AddSubMenuItemCheckbox("Pinned", "List first in the menu, from the next start", deviceConf(d.mac).Pinned)
+	hideItem := d.menu.AddSubMenuItem("Hide", "Move the device to other devices")
+	forgetItem := d.menu.AddSubMenuItem("Forget", "Remove the pairing")
+
+	go func() {
+		for {
+			<-d.trustItem.ClickedCh
+			d.toggle(d.trustItem, "trust", "untrust")
+		}
+	}()
+
+	go func() {
+		for {
+			<-d.blockItem.ClickedCh
+			d.toggle(d.blockItem, "block", "unblock")
+		}
+	}()
+
+	go func() {
+		for {
+			<-renameItem.ClickedCh
+			d.rename()
+		}
+	}()
+
+	go func() {
+		for {
+			<-aliasItem.ClickedCh
+			d.setAlias()
+		}
+	}()
+
+	go func() {
+		for {
+			<-pinItem.ClickedCh
+			pinned := !pinItem.Checked()
+			updateConfig(d.mac, func(c *deviceConfig) { c.Pinned = pinned })
+			if pinned {
+				pinItem.Check()
+			} else {
+				pinItem.Uncheck()
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			<-hideItem.ClickedCh
+			localMtx.Lock()
+			d.hide()
+			localMtx.Unlock()
+		}
+	}()
+
+	go func() {
+		for {
+			<-forgetItem.ClickedCh
+			localMtx.Lock()
+			d.forget()
+			localMtx.Unlock()
+		}
+	}()
+}
+
+// toggle runs the bluetoothctl command flipping a checkbox state
+func (d *device) toggle(item *systray.MenuItem, on string, off string) {
+	localMtx.Lock()
+	cmd := on
+	if item.Checked() {
+		cmd = off
+	}
+
+	// blocking drops the connection, don't take it for a loss
+	d.dropExpected = cmd == "block" && d.connected()
+	localMtx.Unlock()
+
+	output, err := d.bt(context.Background(), cmd)
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if err != nil {
+		d.dropExpected = false
+		d.setError(fmt.Sprintf("failed to %s %s: %s", cmd, d.name, btFailure(output, err)))
+		return
+	}
+
+	if cmd == on {
+		item.Check()
+	} else {
+		item.Uncheck()
+	}
+	d.err = ""
+	d.refreshLabel()
+}
+
+func (d *device) rename() {
+	localMtx.Lock()
+	current := d.name
+	localMtx.Unlock()
+
+	// the dialog can stay open for a while, don't hold the lock meanwhile
+	alias, err := askText("Rename device", "New name for "+current, current)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			reportError("renaming devices needs zenity")
+		}
+		return
+	}
+	if alias == "" || alias == current {
+		return
+	}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	path, err := d.devicePath()
+	if err == nil {
+		err = setBluezProperty(path, "org.bluez.Device1", "Alias", alias)
+	}
+	if err != nil {
+		d.setError(fmt.Sprintf("failed to rename %s: %s", d.name, err))
+		return
+	}
+
+	btLog.Info("renamed device", "device", d.name, "alias", alias, "mac", d.mac)
+	if deviceConf(d.mac).Alias != "" {
+		// the bluebao alias still wins
+		d.err = ""
+		d.refreshLabel()
+		return
+	}
+	setTrayRenamed(d.name, alias)
+	d.name = alias
+	d.err = ""
+	d.refreshLabel()
+}
+
+// setAlias names the device in bluebao only, an empty alias goes back to the bluez name
+func (d *device) setAlias() {
+	localMtx.Lock()
+	current := d.name
+	localMtx.Unlock()
+
+	alias, err := askText("Device alias", "Name shown by bluebao for "+current+", empty for the device name", deviceConf(d.mac).Alias)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			reportError("setting aliases needs zenity")
+		}
+		return
+	}
+	updateConfig(d.mac, func(c *deviceConfig) { c.Alias = alias })
+
+	name := alias
+	if alias == "" {
+		info, err := d.bt(context.Background(), "info")
+		m := aliasRe.FindStringSubmatch(info)
+		if err != nil || m == nil {
+			return // shown from the next start
+		}
+		name = strings.TrimSpace(m[1])
+	}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	btLog.Info("device alias set", "device", d.name, "alias", alias, "mac", d.mac)
+	setTrayRenamed(d.name, name)
+	d.name = name
+	d.refreshLabel()
+}
+
+// askText prompts the user for a line of text, an error is returned if the dialog was cancelled
+func askText(title string, text string, initial string) (string, error) {
+	stdout, err := runCmdTimeout(uiLog, 10*time.Minute, "zenity", "--entry", "--title", title, "--text", text, "--entry-text", initial)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	notifyConnect  = "connect"
+	notifyTakeover = "takeover"
+	notifyFailure  = "failure"
+	notifySink     = "sink"
+	notifyBattery  = "battery"
+	notifyPairing  = "pairing"
+)
+
+var notifyKinds = flag.String("n", "connect,takeover,failure,sink,battery,pairing", "desktop notifications to show, comma separated")
+
+func notifyEnabled(kind string) bool {
+	for _, k := range strings.Split(*notifyKinds, ",") {
+		if strings.TrimSpace(k) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func notify(kind string, summary string, body string) {
+	if !notifyEnabled(kind) {
+		return
+	}
+
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		uiLog.Error("failed to send notification", "err", err)
+		return
+	}
+
+	ctx, cancel := dbusContext(context.Background())
+	defer cancel()
+
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	err = obj.CallWithContext(ctx, "org.freedesktop.Notifications.Notify", 0,
+		"bluebao", uint32(0), "audio-headphones", summary, body,
+		[]string{}, map[string]dbus.Variant{}, int32(-1)).Err
+	if err != nil {
+		uiLog.Error("failed to send notification", "err", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/systray"
+)
+
+var deviceOrder = flag.String("so", "lastused", "device order after pinned ones: lastused, name or paired")
+var groupDevices = flag.Bool("g", false, "group devices by kind: headphones, speakers, car")
+
+// menu groups, in menu order
+var groups = []string{"Headphones", "Speakers", "Car", "Other"}
+
+// audio/video minor classes of device
+var minorGroups = map[uint64]string{
+	0x01: "Headphones", // wearable headset
+	0x02: "Headphones", // hands-free
+	0x06: "Headphones",
+	0x05: "Speakers", // loudspeaker
+	0x07: "Speakers", // portable audio
+	0x0a: "Speakers", // hifi audio
+	0x08: "Car",
+}
+
+var aliasRe = regexp.MustCompile(`Alias: (.*)`)
+
+var groupHeaders = make(map[string]*systray.MenuItem)
+
+// pairedDevice is a device about to be added to the menu
+type pairedDevice struct {
+	mac  string
+	name string
+	info string
+}
+
+// deviceGroup tells the kind of device from its class of device, or its icon
+func deviceGroup(info string) string {
+	if m := classRe.FindStringSubmatch(info); m != nil {
+		class, err := strconv.ParseUint(m[1], 16, 32)
+		if group, ok := minorGroups[(class>>2)&0x3f]; err == nil && class&classMajorMask == classMajorAudio && ok {
+			return group
+		}
+	}
+
+	if m := iconRe.FindStringSubmatch(info); m != nil {
+		switch m[1] {
+		case "audio-headset", "audio-headphones":
+			return "Headphones"
+		case "audio-card":
+			return "Speakers"
+		}
+	}
+	return "Other"
+}
+
+// displayName is the alias set in bluebao, or the bluez name
+func displayName(mac string, name string) string {
+	if alias := deviceConf(mac).Alias; alias != "" {
+		return alias
+	}
+	return name
+}
+
+// sortDevices puts pinned devices first, then follows deviceOrder
+func sortDevices(devs []pairedDevice) {
+	sort.SliceStable(devs, func(i, j int) bool {
+		ci, cj := deviceConf(devs[i].mac), deviceConf(devs[j].mac)
+		if ci.Pinned != cj.Pinned {
+			return ci.Pinned
+		}
+		if *groupDevices {
+			if gi, gj := groupIndex(devs[i].info), groupIndex(devs[j].info); gi != gj {
+				return gi < gj
+			}
+		}
+
+		switch *deviceOrder {
+		case "lastused":
+			return ci.LastUsed > cj.LastUsed
+		case "name":
+			return strings.ToLower(displayName(devs[i].mac, devs[i].name)) < strings.ToLower(displayName(devs[j].mac, devs[j].name))
+		}
+		return false
+	})
+}
+
+func groupIndex(info string) int {
+	group := deviceGroup(info)
+	for i, g := range groups {
+		if g == group {
+			return i
+		}
+	}
+	return len(groups)
+}
+
+// addDevices adds devices in order. Menu entries can't be moved, devices added later on go
+// last. localMtx must be held.
+func addDevices(devs []pairedDevice, objs bluezObjects) {
+	sortDevices(devs)
+
+	pinned := false
+	for _, dev := range devs {
+		// pinned devices stay on top, out of the groups
+		if deviceConf(dev.mac).Pinned {
+			pinned = true
+		} else if group := deviceGroup(dev.info); *groupDevices && groupHeaders[group] == nil {
+			if pinned {
+				systray.AddSeparator()
+				pinned = false
+			}
+			header := systray.AddMenuItem(group, group)
+			header.Disable()
+			groupHeaders[group] = header
+		}
+		addDevice(dev.mac, dev.name, dev.info, objs)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/godbus/dbus/v5"
+)
+
+const agentPath = dbus.ObjectPath("/org/bluebao/agent")
+const scanTimeout = 30 * time.Second
+
+var pairMenu, scanItem, confirmItem, rejectItem *systray.MenuItem
+
+// devices found while scanning, mac address // menu. Entries are hidden, never removed.
+var discovered = make(map[string]*systray.MenuItem)
+var discoveredMtx sync.Mutex
+
+// only one pairing at a time, the agent is registered for its duration
+var pairMtx sync.Mutex
+var confirmCh = make(chan bool)
+
+// bluetoothctl colours its output, e.g. "[\x1b[0;92mNEW\x1b[0m] Device AA:BB:CC:DD:EE:FF WH-1000XM4"
+var ansiRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+var newDeviceRe = regexp.MustCompile(`\[NEW\] Device ([0-9A-F:]{17}) (.+)$`)
+
+var errRejected = dbus.NewError("org.bluez.Error.Rejected", nil)
+var errCanceled = dbus.NewError("org.bluez.Error.Canceled", nil)
+
+func addPairingUI() {
+	pairMenu = systray.AddMenuItem("Pair new device…", "Discover and pair a new audio device")
+	scanItem = pairMenu.AddSubMenuItem("Scan for devices", "Scan for nearby audio devices")
+	confirmItem = pairMenu.AddSubMenuItem("", "Confirm the passkey matches the one shown on the device")
+	rejectItem = pairMenu.AddSubMenuItem("Reject", "Reject pairing")
+	confirmItem.Hide()
+	rejectItem.Hide()
+
+	go func() {
+		for {
+			<-scanItem.ClickedCh
+			go discover()
+		}
+	}()
+
+	// clicks are dropped when no confirmation is pending
+	go func() {
+		for {
+			<-confirmItem.ClickedCh
+			select {
+			case confirmCh <- true:
+			default:
+			}
+		}
+	}()
+	go func() {
+		for {
+			<-rejectItem.ClickedCh
+			select {
+			case confirmCh <- false:
+			default:
+			}
+		}
+	}()
+}
+
+func discover() {
+	scanItem.Disable()
+	scanItem.SetTitle("Scanning…")
+	defer func() {
+		scanItem.SetTitle("Scan for devices")
+		scanItem.Enable()
+	}()
+
+	// bluetoothctl stops by itself, the context is in case it hangs
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout+*cmdTimeout)
+	defer cancel()
+
+	args := []string{"--timeout", strconv.Itoa(int(scanTimeout.Seconds())), "scan", "on"}
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, "bluetoothctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		btLog.Error("cant start discovery", "err", err)
+		reportError("cant start discovery: " + err.Error())
+		return
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(ansiRe.ReplaceAllString(scanner.Text(), ""))
+		if m := newDeviceRe.FindStringSubmatch(line); m != nil {
+			go addDiscovered(m[1], m[2])
+		}
+	}
+
+	err = cmd.Wait()
+	btLog.Debug("command", "cmd", "bluetoothctl "+strings.Join(args, " "), "duration", time.Since(start), "err", err)
+}
+
+func addDiscovered(mac string, name string) {
+	localMtx.Lock()
+	_, paired := localEndpoints[mac]
+	localMtx.Unlock()
+	if paired {
+		return
+	}
+
+	output, err := btOptOut("info", mac)
+	if err != nil || !isAudioDevice(output) {
+		return
+	}
+
+	discoveredMtx.Lock()
+	defer discoveredMtx.Unlock()
+
+	if item, ok := discovered[mac]; ok {
+		item.Show()
+		return
+	}
+
+	btLog.Info("discovered device", "device", name, "mac", mac)
+	item := pairMenu.AddSubMenuItem(name, "Pair "+name)
+	discovered[mac] = item
+
+	go func() {
+		for {
+			<-item.ClickedCh
+			pair(mac, name, item)
+		}
+	}()
+}
+
+func pair(mac string, name string, item *systray.MenuItem) {
+	item.Disable()
+	item.SetTitle(name + " — pairing…")
+	defer func() {
+		item.SetTitle(name)
+		item.Enable()
+	}()
+
+	if err := pairDevice(mac); err != nil {
+		btLog.Error("failed to pair", "device", name, "mac", mac, "err", err)
+		reportError(fmt.Sprintf("failed to pair %s: %s", name, err))
+		notify(notifyFailure, "Pairing failed", fmt.Sprintf("Failed to pair %s: %s", name, err))
+		return
+	}
+
+	btLog.Info("paired", "device", name, "mac", mac)
+	if output, err := btOptOut("trust", mac); err != nil {
+		reportError(fmt.Sprintf("failed to trust %s: %s", name, btFailure(output, err)))
+	}
+	item.Hide()
+	output, _ := btOptOut("info", mac)
+	objs, _ := bluezManagedObjects()
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	// it may have shown up meanwhile, e.g. with an adapter change
+	d, ok := localEndpoints[mac]
+	if !ok {
+		d = addDevice(mac, name, output, objs)
+	}
+	if d.state == stateIdle {
+		d.connect(false)
+	}
+}
+
+// pairDevice pairs over dbus, registering bluebao as the agent handling the pairing requests
+func pairDevice(mac string) error {
+	pairMtx.Lock()
+	defer pairMtx.Unlock()
+
+	conn, err := systemBus()
+	if err != nil {
+		return err
+	}
+
+	path, err := devicePath(mac)
+	if err != nil {
+		return err
+	}
+
+	ag := &agent{device: path, cancel: make(chan struct{}, 1)}
+	if err := conn.Export(ag, agentPath, "org.bluez.Agent1"); err != nil {
+		return err
+	}
+	defer conn.Export(nil, agentPath, "org.bluez.Agent1")
+
+	if err := bluezCall(context.Background(), "/org/bluez", "org.bluez.AgentManager1.RegisterAgent", agentPath, "DisplayYesNo"); err != nil {
+		return err
+	}
+	defer bluezCall(context.Background(), "/org/bluez", "org.bluez.AgentManager1.UnregisterAgent", agentPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	defer cancel()
+	return conn.Object(bluezService, path).CallWithContext(ctx, "org.bluez.Device1.Pair", 0).Err
+}
+
+// agent implements org.bluez.Agent1 for the device being paired, rejecting anything else
+type agent struct {
+	device dbus.ObjectPath
+	cancel chan struct{}
+}
+
+func (a *agent) Release() *dbus.Error {
+	return nil
+}
+
+func (a *agent) RequestPinCode(dev dbus.ObjectPath) (string, *dbus.Error) {
+	if dev != a.device {
+		return "", errRejected
+	}
+	return "0000", nil // legacy headsets almost always use 0000
+}
+
+func (a *agent) DisplayPinCode(dev dbus.ObjectPath, pincode string) *dbus.Error {
+	notify(notifyPairing, "Pairing", "Enter PIN code "+pincode+" on the device")
+	return nil
+}
+
+func (a *agent) RequestPasskey(dev dbus.ObjectPath) (uint32, *dbus.Error) {
+	return 0, errRejected // no keyboard input from the tray
+}
+
+func (a *agent) DisplayPasskey(dev dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	notify(notifyPairing, "Pairing", fmt.Sprintf("Enter passkey %06d on the device", passkey))
+	return nil
+}
+
+func (a *agent) RequestConfirmation(dev dbus.ObjectPath, passkey uint32) *dbus.Error {
+	if dev != a.device {
+		return errRejected
+	}
+
+	code := fmt.Sprintf("%06d", passkey)
+	confirmItem.SetTitle("Confirm passkey " + code)
+	confirmItem.Show()
+	rejectItem.Show()
+	defer func() {
+		confirmItem.Hide()
+		rejectItem.Hide()
+	}()
+	notify(notifyPairing, "Pairing", "Confirm passkey "+code+" from the bluebao menu")
+
+	select {
+	case ok := <-confirmCh:
+		if ok {
+			return nil
+		}
+		return errRejected
+	case <-a.cancel:
+		return errCanceled
+	case <-time.After(30 * time.Second):
+		return errRejected
+	}
+}
+
+func (a *agent) RequestAuthorization(dev dbus.ObjectPath) *dbus.Error {
+	if dev != a.device {
+		return errRejected
+	}
+	return nil // just works pairing, the user asked for it
+}
+
+func (a *agent) AuthorizeService(dev dbus.ObjectPath, uuid string) *dbus.Error {
+	if dev != a.device {
+		return errRejected
+	}
+	return nil
+}
+
+func (a *agent) Cancel() *dbus.Error {
+	select {
+	case a.cancel <- struct{}{}:
+	default:
+	}
+	return nil
+}
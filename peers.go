@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// other bluebao instances seen on the network, hostname // seen
+var peers = make(map[string]bool)
+var peersMtx sync.Mutex
+
+// heldCh receives the devices peers report holding
+var heldCh = make(chan string, 16)
+
+// queryMtx serializes peerHolds, answers aren't tied to a query
+var queryMtx sync.Mutex
+
+// on top of takeovers ("<host>,<mac>"), peers exchange
+//   "<host>,hello" announcing themselves
+//   "<host>,send,<target>,<mac>" handing a device over to target
+//   "<host>,query,<mac>" asking whether anyone holds a device, answered with "<host>,held,<mac>"
+// older versions look these up as mac addresses and ignore them.
+
+func announce() {
+	pushNetwork(hostname + ",hello")
+}
+
+// handlePeerMessage handles the non takeover messages, returning false for takeovers
+func handlePeerMessage(requester string, msg string) bool {
+	if addPeer(requester) {
+		go announce() // make sure newcomers learn about us too
+	}
+
+	switch {
+	case msg == "hello":
+		return true
+	case strings.HasPrefix(msg, "send,"):
+		parts := strings.SplitN(msg, ",", 3)
+		if len(parts) == 3 && parts[1] == hostname {
+			receiveDevice(requester, parts[2])
+		}
+		return true
+	case strings.HasPrefix(msg, "query,"):
+		mac := strings.TrimPrefix(msg, "query,")
+		localMtx.Lock()
+		d, ok := localEndpoints[mac]
+		held := ok && d.connected()
+		localMtx.Unlock()
+		if held {
+			pushNetwork(hostname + ",held," + mac)
+		}
+		return true
+	case strings.HasPrefix(msg, "held,"):
+		select {
+		case heldCh <- strings.TrimPrefix(msg, "held,"):
+		default:
+		}
+		return true
+	}
+
+	return false
+}
+
+// peerHolds asks peers whether one of them is connected to the device
+func peerHolds(mac string) bool {
+	if !*enableNetwork {
+		return false
+	}
+
+	queryMtx.Lock()
+	defer queryMtx.Unlock()
+
+	// drop stale answers
+	for len(heldCh) > 0 {
+		<-heldCh
+	}
+
+	pushNetwork(hostname + ",query," + mac)
+	timeout := time.After(500 * time.Millisecond)
+	for {
+		select {
+		case held := <-heldCh:
+			if held == mac {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func addPeer(name string) bool {
+	peersMtx.Lock()
+	if peers[name] {
+		peersMtx.Unlock()
+		return false
+	}
+	peers[name] = true
+	peersMtx.Unlock()
+
+	netLog.Info("new peer", "peer", name)
+
+	localMtx.Lock()
+	for _, d := range localEndpoints {
+		d.addPeerItem(name)
+	}
+	localMtx.Unlock()
+
+	return true
+}
+
+// addPeerItems adds an entry to the "send to peer" submenu for every known peer. localMtx must be held.
+func (d *device) addPeerItems() {
+	peersMtx.Lock()
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	peersMtx.Unlock()
+
+	for _, name := range names {
+		d.addPeerItem(name)
+	}
+}
+
+// localMtx must be held.
+func (d *device) addPeerItem(peer string) {
+	if _, ok := d.peerItems[peer]; ok {
+		return
+	}
+
+	item := d.peerMenu.AddSubMenuItem(peer, "Send "+d.name+" to "+peer)
+	d.peerItems[peer] = item
+	d.peerMenu.Show()
+
+	go func() {
+		for {
+			<-item.ClickedCh
+			d.sendToPeer(peer)
+		}
+	}()
+}
+
+// sendToPeer drops the device and asks peer to connect it
+func (d *device) sendToPeer(peer string) {
+	localMtx.Lock()
+	done := d.disconnect()
+	localMtx.Unlock()
+	<-done
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+	if d.state != stateIdle {
+		return // failed to disconnect, error already reported
+	}
+
+	netLog.Info("sending device to peer", "device", d.name, "peer", peer)
+	pushNetwork(hostname + ",send," + peer + "," + d.mac)
+}
+
+func receiveDevice(requester string, mac string) {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	d, ok := localEndpoints[mac]
+	if !ok {
+		netLog.Warn("peer sent an unknown device", "peer", requester, "mac", mac)
+		return
+	}
+	if d.state != stateIdle {
+		return
+	}
+
+	netLog.Info("receiving device from peer", "device", d.name, "peer", requester)
+	done := d.connect(false)
+	go func() {
+		<-done
+		localMtx.Lock()
+		defer localMtx.Unlock()
+		if d.connected() {
+			go notify(notifyConnect, "Device received", fmt.Sprintf("%s was sent over by %s", d.name, requester))
+		}
+	}()
+}
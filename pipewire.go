@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// pipewireBackend drives pipewire natively: pw-dump reads the graph, wpctl acts on it
+type pipewireBackend struct{}
+
+type pwProfile struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	Available string `json:"available"` // yes, no, unknown
+}
+
+type pwObject struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"` // e.g. PipeWire:Interface:Node
+	Info *struct {
+		Props  map[string]any `json:"props"`
+		Params struct {
+			EnumProfile []pwProfile `json:"EnumProfile"`
+			Profile     []pwProfile `json:"Profile"`
+		} `json:"params"`
+	} `json:"info"`
+	Props    map[string]any `json:"props"` // metadata only
+	Metadata []struct {
+		Key   string `json:"key"`
+		Value any    `json:"value"`
+	} `json:"metadata"`
+}
+
+// props flattens the properties, pw-dump mixes strings, numbers and booleans
+func (o pwObject) props() map[string]string {
+	props := make(map[string]string)
+	if o.Info == nil {
+		return props
+	}
+	for k, v := range o.Info.Props {
+		props[k] = fmt.Sprint(v)
+	}
+	return props
+}
+
+func pwRun(name string, arg ...string) ([]byte, error) {
+	stdout, err := runCmd(audioLog, name, arg...)
+	if errors.Is(err, exec.ErrNotFound) {
+		setProblem("audio", name+" missing")
+	}
+	return stdout, err
+}
+
+func pwDump() ([]pwObject, error) {
+	stdout, err := pwRun("pw-dump")
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []pwObject
+	if err := json.Unmarshal(stdout, &objs); err != nil {
+		audioLog.Error("cant parse pw-dump output", "err", err)
+		return nil, err
+	}
+	return objs, nil
+}
+
+// pwObjects returns the nodes or devices of a media class, e.g. Audio/Sink
+func pwObjects(kind string, class string) ([]pwObject, error) {
+	objs, err := pwDump()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]pwObject, 0)
+	for _, o := range objs {
+		if o.Type == "PipeWire:Interface:"+kind && o.props()["media.class"] == class {
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
+func (pipewireBackend) name() string {
+	return "pipewire"
+}
+
+func (pipewireBackend) nodes(class string) ([]audioNode, error) {
+	objs, err := pwObjects("Node", class)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]audioNode, 0, len(objs))
+	for _, o := range objs {
+		props := o.props()
+		nodes = append(nodes, audioNode{id: strconv.Itoa(o.ID), name: props["node.name"], mac: bluetoothMac(props, props["node.name"]), props: props})
+	}
+	return nodes, nil
+}
+
+func (p pipewireBackend) sinks() ([]audioNode, error) {
+	return p.nodes("Audio/Sink")
+}
+
+// monitors aren't nodes of their own in pipewire
+func (p pipewireBackend) sources() ([]audioNode, error) {
+	return p.nodes("Audio/Source")
+}
+
+func (pipewireBackend) cards() ([]audioCard, error) {
+	objs, err := pwObjects("Device", "Audio/Device")
+	if err != nil {
+		return nil, err
+	}
+
+	cards := make([]audioCard, 0, len(objs))
+	for _, o := range objs {
+		props := o.props()
+		c := audioCard{id: strconv.Itoa(o.ID), name: props["device.name"], mac: bluetoothMac(props, props["device.name"])}
+		if len(o.Info.Params.Profile) > 0 {
+			c.profile = o.Info.Params.Profile[0].Name
+		}
+		for _, p := range o.Info.Params.EnumProfile {
+			if p.Available != "no" {
+				c.profiles = append(c.profiles, p.Name)
+			}
+		}
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
+
+func (pipewireBackend) streams(class string, keep func(props map[string]string) bool) ([]audioStream, error) {
+	objs, err := pwObjects("Node", class)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]audioStream, 0, len(objs))
+	for _, o := range objs {
+		if props := o.props(); keep(props) {
+			streams = append(streams, audioStream{id: strconv.Itoa(o.ID), props: props})
+		}
+	}
+	return streams, nil
+}
+
+func (p pipewireBackend) playbacks() ([]audioStream, error) {
+	return p.streams("Stream/Output/Audio", func(props map[string]string) bool { return true })
+}
+
+func (p pipewireBackend) recordings() ([]audioStream, error) {
+	return p.streams("Stream/Input/Audio", func(props map[string]string) bool {
+		return props["stream.capture.sink"] != "true" && props["stream.monitor"] != "true"
+	})
+}
+
+func (p pipewireBackend) defaultSink() (string, error) {
+	return p.defaultNode("default.audio.sink")
+}
+
+func (p pipewireBackend) defaultSource() (string, error) {
+	return p.defaultNode("default.audio.source")
+}
+
+// defaultNode reads the default metadata, which holds node names
+func (pipewireBackend) defaultNode(key string) (string, error) {
+	objs, err := pwDump()
+	if err != nil {
+		return "", err
+	}
+
+	name := ""
+	for _, o := range objs {
+		if o.Type != "PipeWire:Interface:Metadata" || fmt.Sprint(o.Props["metadata.name"]) != "default" {
+			continue
+		}
+		for _, m := range o.Metadata {
+			if v, ok := m.Value.(map[string]any); ok && m.Key == key {
+				name = fmt.Sprint(v["name"])
+			}
+		}
+	}
+
+	for _, o := range objs {
+		if o.Type == "PipeWire:Interface:Node" && name != "" && o.props()["node.name"] == name {
+			return strconv.Itoa(o.ID), nil
+		}
+	}
+	return "", fmt.Errorf("no %s", key)
+}
+
+func (pipewireBackend) setDefaultSink(id string) error {
+	_, err := pwRun("wpctl", "set-default", id)
+	return err
+}
+
+func (pipewireBackend) setDefaultSource(id string) error {
+	_, err := pwRun("wpctl", "set-default", id)
+	return err
+}
+
+// setProfile looks the profile index up, wpctl doesn't take names
+func (pipewireBackend) setProfile(card audioCard, profile string) error {
+	objs, err := pwObjects("Device", "Audio/Device")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objs {
+		if strconv.Itoa(o.ID) != card.id {
+			continue
+		}
+		for _, p := range o.Info.Params.EnumProfile {
+			if p.Name == profile {
+				_, err := pwRun("wpctl", "set-profile", card.id, strconv.Itoa(p.Index))
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("no profile %s on %s", profile, card.name)
+}
+
+func (pipewireBackend) volume(sink audioNode) (int, error) {
+	stdout, err := pwRun("wpctl", "get-volume", sink.id)
+	if err != nil {
+		return -1, err
+	}
+	return parseWpctlVolume(string(stdout))
+}
+
+// parseWpctlVolume parses e.g. "Volume: 0.50 [MUTED]"
+func parseWpctlVolume(stdout string) (int, error) {
+	fields := strings.Fields(stdout)
+	if len(fields) < 2 {
+		return -1, fmt.Errorf("no volume in %q", stdout)
+	}
+	level, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return -1, err
+	}
+	return int(math.Round(level * 100)), nil
+}
+
+func (pipewireBackend) setVolume(sink audioNode, level int) error {
+	_, err := pwRun("wpctl", "set-volume", sink.id, fmt.Sprintf("%.2f", float64(level)/100))
+	return err
+}
+
+// streams without a target follow the default already, the others get their target cleared
+// so they follow it too instead of being pinned to the bluetooth node. The default is set first.
+func (pipewireBackend) movePlayback(s audioStream, sink audioNode) error {
+	return clearTarget(s)
+}
+
+func (pipewireBackend) moveRecording(s audioStream, source audioNode) error {
+	return clearTarget(s)
+}
+
+func clearTarget(s audioStream) error {
+	_, err := pwRun("pw-metadata", "-d", s.id, "target.object")
+	return err
+}
+
+// watchRecordings follows the graph changes, only recording streams and removals matter
+func (pipewireBackend) watchRecordings(changed chan<- struct{}) error {
+	cmd := exec.Command("pw-dump", "--monitor")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, `"Stream/Input/Audio"`) || strings.Contains(line, `"info": null`) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseWpctlVolume(t *testing.T) {
+	tests := []struct {
+		stdout string
+		want   int
+		err    bool
+	}{
+		{"Volume: 0.50\n", 50, false},
+		{"Volume: 0.50 [MUTED]\n", 50, false},
+		{"Volume: 1.00\n", 100, false},
+		{"Volume: 1.50\n", 150, false},
+		{"Volume: 0.29\n", 29, false},
+		{"Volume: 0.00\n", 0, false},
+		{"Volume:\n", 0, true},
+		{"Volume: muted\n", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseWpctlVolume(tt.stdout)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseWpctlVolume(%q) = %d, want an error", tt.stdout, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseWpctlVolume(%q) = %d, %v, want %d", tt.stdout, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pulseBackend drives pulseaudio, or pipewire through pipewire-pulse, with pactl
+type pulseBackend struct{}
+
+// pactl get-sink-volume reports e.g. "Volume: front-left: 32768 /  50% / -18.06 dB, ..."
+var pactlVolumeRe = regexp.MustCompile(`(\d+)%`)
+
+type pactlEntry struct {
+	Index      int               `json:"index"`
+	Name       string            `json:"name"`
+	Sink       int               `json:"sink"`   // sink-inputs only
+	Source     int               `json:"source"` // source-outputs only
+	Properties map[string]string `json:"properties"`
+
+	// cards only
+	ActiveProfile string `json:"active_profile"`
+	Profiles      map[string]struct {
+		Available bool `json:"available"`
+	} `json:"profiles"`
+}
+
+func pactl(arg ...string) ([]byte, error) {
+	stdout, err := runCmd(audioLog, "pactl", arg...)
+	if errors.Is(err, exec.ErrNotFound) {
+		setProblem("audio", "pactl missing")
+	}
+	return stdout, err
+}
+
+func pactlList(entryType string) ([]pactlEntry, error) {
+	stdout, err := pactl("-f", "json", "list", entryType)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []pactlEntry
+	if err := json.Unmarshal(stdout, &out); err != nil {
+		audioLog.Error("cant parse pactl output", "err", err)
+		return nil, err
+	}
+	return out, nil
+}
+
+func pactlMonitor(e pactlEntry) bool {
+	return strings.HasSuffix(e.Name, ".monitor") || e.Properties["device.class"] == "monitor"
+}
+
+func (pulseBackend) name() string {
+	return "pulse"
+}
+
+func (pulseBackend) nodes(entryType string, keep func(e pactlEntry) bool) ([]audioNode, error) {
+	entries, err := pactlList(entryType)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]audioNode, 0, len(entries))
+	for _, e := range entries {
+		if keep(e) {
+			nodes = append(nodes, audioNode{id: e.Name, name: e.Name, mac: bluetoothMac(e.Properties, e.Name), props: e.Properties})
+		}
+	}
+	return nodes, nil
+}
+
+func (p pulseBackend) sinks() ([]audioNode, error) {
+	return p.nodes("sinks", func(e pactlEntry) bool { return true })
+}
+
+func (p pulseBackend) sources() ([]audioNode, error) {
+	return p.nodes("sources", func(e pactlEntry) bool { return !pactlMonitor(e) })
+}
+
+func (pulseBackend) cards() ([]audioCard, error) {
+	entries, err := pactlList("cards")
+	if err != nil {
+		return nil, err
+	}
+
+	cards := make([]audioCard, 0, len(entries))
+	for _, e := range entries {
+		c := audioCard{id: e.Name, name: e.Name, mac: bluetoothMac(e.Properties, e.Name), profile: e.ActiveProfile}
+		for name, p := range e.Profiles {
+			if p.Available {
+				c.profiles = append(c.profiles, name)
+			}
+		}
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
+
+func (pulseBackend) playbacks() ([]audioStream, error) {
+	entries, err := pactlList("sink-inputs")
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]audioStream, 0, len(entries))
+	for _, e := range entries {
+		streams = append(streams, audioStream{id: strconv.Itoa(e.Index), props: e.Properties})
+	}
+	return streams, nil
+}
+
+func (pulseBackend) recordings() ([]audioStream, error) {
+	sources, err := pactlList("sources")
+	if err != nil {
+		return nil, err
+	}
+	monitors := make(map[int]bool)
+	for _, s := range sources {
+		monitors[s.Index] = pactlMonitor(s)
+	}
+
+	entries, err := pactlList("source-outputs")
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]audioStream, 0, len(entries))
+	for _, e := range entries {
+		// pipewire flags peak meters (e.g. pavucontrol) as monitors
+		if !monitors[e.Source] && e.Properties["stream.monitor"] != "true" {
+			streams = append(streams, audioStream{id: strconv.Itoa(e.Index), props: e.Properties})
+		}
+	}
+	return streams, nil
+}
+
+func (pulseBackend) defaultSink() (string, error) {
+	stdout, err := pactl("get-default-sink")
+	return strings.TrimSpace(string(stdout)), err
+}
+
+func (pulseBackend) defaultSource() (string, error) {
+	stdout, err := pactl("get-default-source")
+	return strings.TrimSpace(string(stdout)), err
+}
+
+func (pulseBackend) setDefaultSink(id string) error {
+	_, err := pactl("set-default-sink", id)
+	return err
+}
+
+func (pulseBackend) setDefaultSource(id string) error {
+	_, err := pactl("set-default-source", id)
+	return err
+}
+
+func (pulseBackend) setProfile(card audioCard, profile string) error {
+	_, err := pactl("set-card-profile", card.id, profile)
+	return err
+}
+
+func (pulseBackend) volume(sink audioNode) (int, error) {
+	stdout, err := pactl("get-sink-volume", sink.id)
+	if err != nil {
+		return -1, err
+	}
+	return parsePactlVolume(string(stdout))
+}
+
+// parsePactlVolume reads the level of the first channel
+func parsePactlVolume(stdout string) (int, error) {
+	m := pactlVolumeRe.FindStringSubmatch(stdout)
+	if m == nil {
+		return -1, fmt.Errorf("no volume in %q", stdout)
+	}
+	return strconv.Atoi(m[1])
+}
+
+func (pulseBackend) setVolume(sink audioNode, level int) error {
+	_, err := pactl("set-sink-volume", sink.id, fmt.Sprintf("%d%%", level))
+	return err
+}
+
+func (pulseBackend) movePlayback(s audioStream, sink audioNode) error {
+	_, err := pactl("move-sink-input", s.id, sink.id)
+	return err
+}
+
+func (pulseBackend) moveRecording(s audioStream, source audioNode) error {
+	_, err := pactl("move-source-output", s.id, source.id)
+	return err
+}
+
+func (pulseBackend) watchRecordings(changed chan<- struct{}) error {
+	cmd := exec.Command("pactl", "subscribe")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// e.g. "Event 'new' on source-output #42"
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "on source-output") && (strings.Contains(line, "'new'") || strings.Contains(line, "'remove'")) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return cmd.Wait()
+}
+
+// pulseaudio 15+ has no per codec profiles, it switches codecs with a message to the card
+func (pulseBackend) listCodecs(card audioCard) ([]string, error) {
+	stdout, err := pactl("send-message", "/card/"+card.id+"/bluez", "list-codecs")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(stdout, &list); err != nil {
+		audioLog.Error("cant parse pactl output", "err", err)
+		return nil, err
+	}
+
+	codecs := make([]string, 0, len(list))
+	for _, l := range list {
+		codecs = append(codecs, l.Name)
+	}
+	return codecs, nil
+}
+
+func (pulseBackend) switchCodec(card audioCard, codec string) error {
+	_, err := pactl("send-message", "/card/"+card.id+"/bluez", "switch-codec", `"`+codec+`"`)
+	return err
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestParsePactlVolume(t *testing.T) {
+	tests := []struct {
+		stdout string
+		want   int
+		err    bool
+	}{
+		{"Volume: front-left: 32768 /  50% / -18.06 dB,   front-right: 32768 /  50% / -18.06 dB\n        balance 0.00\n", 50, false},
+		{"Volume: front-left: 45875 /  70% / -9.29 dB,   front-right: 39321 /  60% / -13.31 dB\n", 70, false},
+		{"Volume: mono: 65536 / 100% / 0.00 dB\n", 100, false},
+		{"Volume: front-left: 98304 / 150% / 10.57 dB,   front-right: 98304 / 150% / 10.57 dB\n", 150, false},
+		{"Volume: front-left: 0 /   0% / -inf dB,   front-right: 0 /   0% / -inf dB\n", 0, false},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePactlVolume(tt.stdout)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parsePactlVolume(%q) = %d, want an error", tt.stdout, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parsePactlVolume(%q) = %d, %v, want %d", tt.stdout, got, err, tt.want)
+		}
+	}
+}
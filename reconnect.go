@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const reconnectBase = 2 * time.Second
+const reconnectMax = 5 * time.Minute
+const reconnectAttempts = 10
+
+// startReconnect retries connecting a device that dropped unexpectedly. localMtx must be held.
+func (d *device) startReconnect() {
+	d.reconnectGen++
+	go d.reconnectLoop(d.reconnectGen)
+}
+
+// stopReconnect cancels a pending reconnection. localMtx must be held.
+func (d *device) stopReconnect() {
+	d.reconnectGen++
+	if d.reconnect != "" {
+		d.reconnect = ""
+		d.refreshLabel()
+	}
+}
+
+func (d *device) reconnectLoop(gen int) {
+	delay := reconnectBase
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		localMtx.Lock()
+		if d.reconnectGen != gen {
+			localMtx.Unlock()
+			return
+		}
+		d.reconnect = fmt.Sprintf("connection lost, reconnect attempt %d/%d in %s", attempt, reconnectAttempts, delay)
+		d.refreshLabel()
+		localMtx.Unlock()
+
+		time.Sleep(delay)
+
+		localMtx.Lock()
+		done := d.reconnectGen != gen || d.connected()
+		localMtx.Unlock()
+		if done || autoConnect(d.mac, "keep connected") {
+			return
+		}
+
+		delay = min(delay*2, reconnectMax)
+	}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+	if d.reconnectGen == gen {
+		d.reconnect = ""
+		d.setError(fmt.Sprintf("gave up reconnecting %s after %d attempts", d.name, reconnectAttempts))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// see linux/rfkill.h
+const (
+	rfkillTypeBluetooth = 2
+	rfkillOpAdd         = 0
+	rfkillOpDel         = 1
+	rfkillOpChange      = 2
+	rfkillEventSize     = 8
+)
+
+type rfkillState struct {
+	idx  uint32
+	name string // hci0, or a platform switch e.g. tpacpi_bluetooth_sw
+	soft bool
+	hard bool
+}
+
+// bluetooth rfkill switches, rfkill index // state
+var rfkills = make(map[uint32]rfkillState)
+var rfkillMtx sync.Mutex
+
+// loadRfkill reads the current state of the bluetooth switches from sysfs, so it's known before
+// watchRfkill gets going
+func loadRfkill() {
+	dirs, _ := filepath.Glob("/sys/class/rfkill/rfkill*")
+	for _, dir := range dirs {
+		read := func(file string) string {
+			buf, _ := os.ReadFile(filepath.Join(dir, file))
+			return strings.TrimSpace(string(buf))
+		}
+
+		idx, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(dir), "rfkill"), 10, 32)
+		if err != nil || read("type") != "bluetooth" {
+			continue
+		}
+
+		rfkillMtx.Lock()
+		rfkills[uint32(idx)] = rfkillState{idx: uint32(idx), name: read("name"), soft: read("soft") == "1", hard: read("hard") == "1"}
+		rfkillMtx.Unlock()
+	}
+}
+
+// watchRfkill follows the bluetooth rfkill switches. Reading /dev/rfkill first returns the
+// current state of every switch, then blocks for changes.
+func watchRfkill() {
+	f, err := os.Open("/dev/rfkill")
+	if err != nil {
+		btLog.Warn("cant watch rfkill", "err", err)
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64) // newer kernels send larger events, with a common prefix
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			btLog.Warn("cant read rfkill", "err", err)
+			return
+		}
+		if n < rfkillEventSize || buf[4] != rfkillTypeBluetooth {
+			continue
+		}
+
+		s := rfkillState{
+			idx:  binary.NativeEndian.Uint32(buf[0:4]),
+			soft: buf[6] != 0,
+			hard: buf[7] != 0,
+		}
+		name, _ := os.ReadFile(fmt.Sprintf("/sys/class/rfkill/rfkill%d/name", s.idx))
+		s.name = strings.TrimSpace(string(name))
+
+		rfkillMtx.Lock()
+		if buf[5] == rfkillOpDel {
+			delete(rfkills, s.idx)
+		} else {
+			rfkills[s.idx] = s
+		}
+		rfkillMtx.Unlock()
+
+		btLog.Debug("rfkill", "name", s.name, "soft", s.soft, "hard", s.hard)
+		go refreshAdapters()
+	}
+}
+
+// rfkillBlocked reports whether an adapter (e.g. hci0) is blocked, by its own switch or a
+// platform wide one
+func rfkillBlocked(hci string) (soft bool, hard bool) {
+	rfkillMtx.Lock()
+	defer rfkillMtx.Unlock()
+
+	for _, s := range rfkills {
+		if s.name == hci || !strings.HasPrefix(s.name, "hci") {
+			soft = soft || s.soft
+			hard = hard || s.hard
+		}
+	}
+	return soft, hard
+}
+
+// rfkillUnblock lifts the soft blocks applying to an adapter. Hard blocks are physical switches.
+func rfkillUnblock(hci string) error {
+	f, err := os.OpenFile("/dev/rfkill", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rfkillMtx.Lock()
+	defer rfkillMtx.Unlock()
+
+	for _, s := range rfkills {
+		if !s.soft || (s.name != hci && strings.HasPrefix(s.name, "hci")) {
+			continue
+		}
+
+		ev := make([]byte, rfkillEventSize)
+		binary.NativeEndian.PutUint32(ev[0:4], s.idx)
+		ev[4] = rfkillTypeBluetooth
+		ev[5] = rfkillOpChange
+		if _, err := f.Write(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
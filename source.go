@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+)
+
+// default source before the bluetooth microphone took over, restored once it goes away
+var (
+	previousSource string // id
+	sourceMtx      sync.Mutex
+)
+
+// useBluetoothSource sets the microphone of the device as default source, remembering the
+// previous one. The microphone only exists with a headset profile.
+func useBluetoothSource(mac string, attempts int) bool {
+	source := findNode(audio.sources, attempts, onDevice(mac))
+	if source == nil {
+		return false
+	}
+
+	current, err := audio.defaultSource()
+	sourceMtx.Lock()
+	if err == nil && current != source.id && previousSource == "" {
+		previousSource = current
+	}
+	sourceMtx.Unlock()
+
+	if err := audio.setDefaultSource(source.id); err != nil {
+		audioLog.Error("failed to set default source", "source", source.name, "err", err)
+		reportError("failed to set default source: " + err.Error())
+		return false
+	}
+
+	audioLog.Info("default source set", "source", source.name)
+	moveSourceOutputs(*source)
+	return true
+}
+
+// restoreDefaultSource goes back to the source in use before the bluetooth microphone
+func restoreDefaultSource() {
+	sourceMtx.Lock()
+	id := previousSource
+	previousSource = ""
+	sourceMtx.Unlock()
+
+	if id == "" {
+		return
+	}
+
+	// it may have been unplugged meanwhile, the server picks another one then
+	source := findNode(audio.sources, 1, func(n audioNode) bool { return n.id == id })
+	if source == nil {
+		audioLog.Warn("previous default source is gone", "source", id)
+		return
+	}
+	if err := audio.setDefaultSource(source.id); err != nil {
+		audioLog.Warn("failed to restore default source", "source", source.name, "err", err)
+		return
+	}
+	audioLog.Info("default source restored", "source", source.name)
+	moveSourceOutputs(*source)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/systray"
+)
+
+// problems degrading the whole app, keyed by source (adapter, audio...)
+var problems = make(map[string]string)
+var lastError string
+var statusMtx sync.Mutex
+
+// connection state shown by the tray icon and tooltip
+var connectingName string
+var connectedName, connectedCodec string
+
+// disabled menu entry on top of the menu showing what's wrong, set up by startUI
+var statusItem *systray.MenuItem
+
+// setProblem flags bluebao as degraded until clearProblem is called for the same source
+func setProblem(source string, msg string) {
+	statusMtx.Lock()
+	problems[source] = msg
+	lastError = msg
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+func clearProblem(source string) {
+	statusMtx.Lock()
+	delete(problems, source)
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+// reportError records a transient failure, shown in the tooltip without degrading the tray icon
+func reportError(msg string) {
+	statusMtx.Lock()
+	lastError = msg
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+// setTrayConnecting flags a connection attempt in progress, "" when done
+func setTrayConnecting(name string) {
+	statusMtx.Lock()
+	connectingName = name
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+func setTrayConnected(name string, codec string) {
+	statusMtx.Lock()
+	connectedName, connectedCodec = name, codec
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+// setTrayDisconnected clears the connected device, if it's still the one shown
+func setTrayDisconnected(name string) {
+	statusMtx.Lock()
+	if connectedName == name {
+		connectedName, connectedCodec = "", ""
+	}
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+func setTrayRenamed(name string, alias string) {
+	statusMtx.Lock()
+	if connectedName == name {
+		connectedName = alias
+	}
+	statusMtx.Unlock()
+	refreshTray()
+}
+
+func refreshTray() {
+	statusMtx.Lock()
+	defer statusMtx.Unlock()
+
+	if statusItem == nil {
+		return // ui not ready yet, refreshed once it is
+	}
+
+	msgs := make([]string, 0, len(problems))
+	for _, msg := range problems {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+
+	tooltip := "bluebao"
+	switch {
+	case connectingName != "":
+		tooltip += "\nconnecting to " + connectingName + "…"
+	case connectedName != "" && connectedCodec != "":
+		tooltip += "\nconnected to " + connectedName + " (" + connectedCodec + ")"
+	case connectedName != "":
+		tooltip += "\nconnected to " + connectedName
+	default:
+		tooltip += "\nno device connected"
+	}
+	if lastError != "" {
+		tooltip += "\nlast error: " + lastError
+	}
+	systray.SetTooltip(tooltip)
+
+	if len(msgs) == 0 {
+		switch {
+		case connectingName != "":
+			systray.SetIcon(iconConnecting)
+		case connectedName != "":
+			systray.SetIcon(iconConnected)
+		default:
+			systray.SetIcon(iconIdle)
+		}
+		statusItem.Hide()
+		return
+	}
+
+	systray.SetIcon(iconDegraded)
+	statusItem.SetTitle("⚠ " + strings.Join(msgs, ", "))
+	statusItem.SetTooltip(tooltip)
+	statusItem.Show()
+}
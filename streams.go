@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var moveStreams = flag.Bool("ms", true, "move playing and recording streams to the new default")
+var moveExclude = flag.String("mx", "", "applications whose streams are never moved, comma separated")
+
+func (s audioStream) app() string {
+	if name := s.props["application.name"]; name != "" {
+		return name
+	}
+	return s.props["application.process.binary"]
+}
+
+// matches tells if the application name or binary is in the comma separated list, case insensitive
+func (s audioStream) matches(list string) bool {
+	for _, app := range strings.Split(list, ",") {
+		app = strings.TrimSpace(app)
+		if app == "" {
+			continue
+		}
+		if strings.EqualFold(app, s.props["application.name"]) || strings.EqualFold(app, s.props["application.process.binary"]) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveSinkInputs moves what's playing to sink, the audio server only does it for new streams
+func moveSinkInputs(sink audioNode) {
+	if !*moveStreams {
+		return
+	}
+
+	streams, err := audio.playbacks()
+	if err != nil {
+		return
+	}
+	for _, s := range streams {
+		if s.matches(*moveExclude) {
+			audioLog.Debug("not moving excluded stream", "app", s.app())
+			continue
+		}
+		if err := audio.movePlayback(s, sink); err != nil {
+			audioLog.Warn("failed to move stream", "app", s.app(), "sink", sink.name, "err", err)
+		}
+	}
+}
+
+// moveSourceOutputs moves what's recording a microphone to source
+func moveSourceOutputs(source audioNode) {
+	if !*moveStreams {
+		return
+	}
+
+	streams, err := audio.recordings()
+	if err != nil {
+		return
+	}
+	for _, s := range streams {
+		if s.matches(*moveExclude) {
+			audioLog.Debug("not moving excluded stream", "app", s.app())
+			continue
+		}
+		if err := audio.moveRecording(s, source); err != nil {
+			audioLog.Warn("failed to move stream", "app", s.app(), "source", source.name, "err", err)
+		}
+	}
+}
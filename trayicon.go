@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+var (
+	iconIdle       = iconGrayscale()
+	iconConnecting = iconWithBadge(color.RGBA{0xe6, 0xa1, 0x17, 0xff})
+	iconConnected  = iconWithBadge(color.RGBA{0x2b, 0x9a, 0x4a, 0xff})
+	iconDegraded   = iconWithBadge(color.RGBA{0xd9, 0x2b, 0x2b, 0xff})
+)
+
+// icoPNG returns the first image of an .ico file, which for the bao icon is a 256px png
+func icoPNG(ico []byte) []byte {
+	size := binary.LittleEndian.Uint32(ico[14:18])
+	offset := binary.LittleEndian.Uint32(ico[18:22])
+	return ico[offset : offset+size]
+}
+
+// iconWithBadge draws a coloured dot in the bottom right corner of the bao icon
+func iconWithBadge(c color.Color) []byte {
+	base, err := png.Decode(bytes.NewReader(icoPNG(Icon)))
+	if err != nil {
+		return Icon
+	}
+
+	bounds := base.Bounds()
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, bounds, base, bounds.Min, draw.Src)
+
+	r := bounds.Dx() / 5
+	cx, cy := bounds.Max.X-r-4, bounds.Max.Y-r-4
+	fillCircle(img, cx, cy, r+4, color.White)
+	fillCircle(img, cx, cy, r, c)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return Icon
+	}
+	return buf.Bytes()
+}
+
+// iconGrayscale returns a washed out bao, used when nothing is connected
+func iconGrayscale() []byte {
+	base, err := png.Decode(bytes.NewReader(icoPNG(Icon)))
+	if err != nil {
+		return Icon
+	}
+
+	bounds := base.Bounds()
+	img := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(base.At(x, y)).(color.NRGBA)
+			gray := color.GrayModel.Convert(c).(color.Gray)
+			img.Set(x, y, color.NRGBA{gray.Y, gray.Y, gray.Y, c.A / 2})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return Icon
+	}
+	return buf.Bytes()
+}
+
+func fillCircle(img *image.RGBA, cx int, cy int, r int, c color.Color) {
+	for y := cy - r; y <= cy+r; y++ {
+		for x := cx - r; x <= cx+r; x++ {
+			if (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r {
+				img.Set(x, y, c)
+			}
+		}
+	}
+}
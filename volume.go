@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+)
+
+var volumePresets = []int{25, 50, 75, 100}
+
+const volumeStep = 10
+
+// sink returns the sink of the device, waiting a bit for it to show up
+func (d *device) sink(attempts int) *audioNode {
+	return findNode(audio.sinks, attempts, onDevice(d.mac))
+}
+
+func sinkVolume(sink audioNode) int {
+	level, err := audio.volume(sink)
+	if err != nil {
+		audioLog.Warn("failed to read volume", "sink", sink.name, "err", err)
+		return -1
+	}
+	return level
+}
+
+// addVolumeUI adds the volume submenu, shown while connected. localMtx must be held.
+func (d *device) addVolumeUI() {
+	d.volumeItem = d.menu.AddSubMenuItem("", "Volume")
+	d.volumeItem.Hide()
+	up := d.volumeItem.AddSubMenuItem(fmt.Sprintf("+%d%%", volumeStep), "Louder")
+	down := d.volumeItem.AddSubMenuItem(fmt.Sprintf("−%d%%", volumeStep), "Quieter")
+
+	go func() {
+		for {
+			step := volumeStep
+			select {
+			case <-up.ClickedCh:
+			case <-down.ClickedCh:
+				step = -volumeStep
+			}
+
+			localMtx.Lock()
+			level := d.volume
+			localMtx.Unlock()
+			if level >= 0 {
+				d.setVolume(level + step)
+			}
+		}
+	}()
+
+	for _, level := range volumePresets {
+		item := d.volumeItem.AddSubMenuItem(fmt.Sprintf("%d%%", level), fmt.Sprintf("Set the volume to %d%%", level))
+		go func(level int) {
+			for {
+				<-item.ClickedCh
+				d.setVolume(level)
+			}
+		}(level)
+	}
+}
+
+// setVolume sets and remembers the volume of the device
+func (d *device) setVolume(level int) {
+	level = max(0, min(level, 100))
+
+	sink := d.sink(1)
+	if sink == nil {
+		reportError("no audio output for " + d.name)
+		return
+	}
+
+	if err := audio.setVolume(*sink, level); err != nil {
+		audioLog.Error("failed to set volume", "sink", sink.name, "err", err)
+		reportError("failed to set volume: " + err.Error())
+		return
+	}
+	updateConfig(d.mac, func(c *deviceConfig) { c.Volume = level })
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+	d.volume = level
+	d.refreshLabel()
+}
+
+// restoreVolume applies the volume remembered for the device, before any stream goes to it,
+// and returns the current volume
+func (d *device) restoreVolume() int {
+	sink := d.sink(10)
+	if sink == nil {
+		return -1
+	}
+
+	if level := deviceConf(d.mac).Volume; level > 0 {
+		audioLog.Info("restoring volume", "device", d.name, "volume", level)
+		if err := audio.setVolume(*sink, level); err != nil {
+			audioLog.Error("failed to restore volume", "sink", sink.name, "err", err)
+		}
+	}
+	return sinkVolume(*sink)
+}
+
+// saveVolume remembers the volume before disconnecting, it may have been changed elsewhere
+func (d *device) saveVolume() {
+	sink := d.sink(1)
+	if sink == nil {
+		return
+	}
+
+	if level := sinkVolume(*sink); level > 0 {
+		updateConfig(d.mac, func(c *deviceConfig) { c.Volume = level })
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type deviceState int
+
+const (
+	stateIdle deviceState = iota
+	stateConnecting
+	stateConnected
+	stateDisconnecting
+)
+
+type opKind int
+
+const (
+	opConnect opKind = iota
+	opDisconnect
+	opForget
+	opHide
+)
+
+// op is a connection request, processed in order by the device worker
+type op struct {
+	kind   opKind
+	ctx    context.Context
+	cancel context.CancelFunc
+	auto   bool // automatic connection: quiet, no takeover
+	done   chan struct{}
+}
+
+// connectMtx is held by the worker connecting a device
+var connectMtx sync.Mutex
+
+// worker runs the connections and disconnections of a device, so slow bluetooth calls
+// don't hold localMtx
+func (d *device) worker() {
+	for o := range d.ops {
+		localMtx.Lock()
+		removed := d.removed
+		localMtx.Unlock()
+
+		switch {
+		case removed:
+			// queued before the device went away, nothing left to do
+			if o.cancel != nil {
+				o.cancel()
+			}
+		case o.kind == opConnect:
+			d.doConnect(o)
+		case o.kind == opDisconnect:
+			d.doDisconnect()
+		case o.kind == opForget, o.kind == opHide:
+			d.doRemove(o.kind)
+		}
+		close(o.done)
+	}
+}
+
+// connect queues a connection, auto ones give up quietly. The returned channel is closed once
+// it's done. localMtx must be held.
+func (d *device) connect(auto bool) <-chan struct{} {
+	ctx, cancel := context.WithCancel(context.Background())
+	return d.queue(op{kind: opConnect, ctx: ctx, cancel: cancel, auto: auto, done: make(chan struct{})})
+}
+
+// disconnect queues a disconnection, see connect. localMtx must be held.
+func (d *device) disconnect() <-chan struct{} {
+	return d.queue(op{kind: opDisconnect, done: make(chan struct{})})
+}
+
+// forget queues the removal of the pairing, disconnecting first, see connect. localMtx must be held.
+func (d *device) forget() <-chan struct{} {
+	if d.state == stateConnecting {
+		d.cancelConnect()
+	}
+	return d.queue(op{kind: opForget, done: make(chan struct{})})
+}
+
+func (d *device) queue(o op) <-chan struct{} {
+	if d.removed {
+		if o.cancel != nil {
+			o.cancel()
+		}
+		close(o.done)
+		return o.done
+	}
+	d.ops <- o
+	return o.done
+}
+
+func (d *device) connected() bool {
+	return d.state == stateConnected
+}
+
+// clicked toggles the connection, or cancels it while connecting
+func (d *device) clicked() {
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	// the user's choice wins over pending reconnections
+	for _, other := range localEndpoints {
+		other.stopReconnect()
+	}
+
+	switch d.state {
+	case stateIdle:
+		d.connect(false)
+	case stateConnecting:
+		if d.quiet {
+			// shown as idle, the user wants it connected for real
+			d.cancelConnect()
+			d.connect(false)
+			return
+		}
+		btLog.Info("cancelling connection", "device", d.name, "mac", d.mac)
+		d.cancelConnect()
+	case stateConnected:
+		d.disconnect()
+	}
+}
+
+func (d *device) doConnect(o op) {
+	defer o.cancel()
+
+	localMtx.Lock()
+	if d.state != stateIdle {
+		localMtx.Unlock()
+		return
+	}
+
+	// don't bother peers nor bluez if the adapter is off or blocked
+	if problem := adapterProblem(d.adapter); problem != "" {
+		if !o.auto {
+			d.setError(fmt.Sprintf("cant connect %s: %s", d.name, problem))
+			go notify(notifyFailure, "Connection failed", fmt.Sprintf("Cant connect %s: %s", d.name, problem))
+		}
+		localMtx.Unlock()
+		return
+	}
+
+	d.state = stateConnecting
+	d.quiet = o.auto
+	d.cancelConnect = o.cancel
+	d.refreshLabel()
+	name := d.name
+
+	// quiet attempts can hold connectMtx for a whole page timeout, the user's choice goes first
+	if !o.auto {
+		for _, other := range localEndpoints {
+			if other != d && other.state == stateConnecting && other.quiet {
+				other.cancelConnect()
+			}
+		}
+	}
+	localMtx.Unlock()
+
+	// one connection at a time, or two devices connecting together would both stay connected
+	connectMtx.Lock()
+	defer connectMtx.Unlock()
+
+	localMtx.Lock()
+	if o.ctx.Err() != nil {
+		btLog.Info("connection cancelled", "device", d.name, "mac", d.mac)
+		d.state = stateIdle
+		d.refreshLabel()
+		localMtx.Unlock()
+		return
+	}
+
+	others := make([]*device, 0)
+	for _, other := range localEndpoints {
+		if other != d && other.connected() {
+			others = append(others, other)
+		}
+	}
+	localMtx.Unlock()
+
+	if !o.auto {
+		setTrayConnecting(name)
+		defer setTrayConnecting("")
+		pushNetwork(hostname + "," + d.mac)
+	}
+
+	// only 1 audio device allowed at the same time, disconnect others
+	for _, other := range others {
+		localMtx.Lock()
+		done := other.disconnect()
+		localMtx.Unlock()
+		<-done
+	}
+
+	// allow for network propagation
+	sleepContext(o.ctx, 200*time.Millisecond)
+
+	output, err := d.bt(o.ctx, "connect")
+	retries := *connectRetries
+	if o.auto {
+		retries = 0
+	}
+	for attempt := 0; err != nil && attempt < retries && o.ctx.Err() == nil; attempt++ {
+		delay := connectRetryDelay(btFailure(output, err), attempt)
+		btLog.Warn("failed to connect, retrying", "device", name, "mac", d.mac, "reason", btFailure(output, err), "in", delay)
+		sleepContext(o.ctx, delay)
+		output, err = d.bt(o.ctx, "connect")
+	}
+
+	if o.ctx.Err() != nil {
+		// bluez may still complete the connection in the background
+		d.bt(context.Background(), "disconnect")
+	}
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if err != nil && unreachable(btFailure(output, err)) {
+		d.away = true
+	}
+
+	switch {
+	case o.ctx.Err() != nil:
+		btLog.Info("connection cancelled", "device", d.name, "mac", d.mac)
+		d.state = stateIdle
+		d.refreshLabel()
+	case err == nil:
+		d.onConnected()
+	case o.auto:
+		btLog.Debug("auto-connect failed", "device", d.name, "mac", d.mac, "reason", btFailure(output, err))
+		d.state = stateIdle
+		d.refreshLabel()
+	default:
+		btLog.Error("failed to connect", "device", d.name, "mac", d.mac, "reason", btFailure(output, err))
+		d.state = stateIdle
+		d.setError(fmt.Sprintf("failed to connect %s: %s", d.name, btFailure(output, err)))
+		go notify(notifyFailure, "Connection failed", fmt.Sprintf("Failed to connect %s: %s", d.name, btFailure(output, err)))
+	}
+}
+
+func (d *device) doDisconnect() {
+	localMtx.Lock()
+	if d.state != stateConnected {
+		localMtx.Unlock()
+		return
+	}
+	d.state = stateDisconnecting
+	d.refreshLabel()
+	localMtx.Unlock()
+
+	d.saveVolume()
+	go restoreDefaultSink()
+	output, err := d.bt(context.Background(), "disconnect")
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	if err != nil {
+		btLog.Error("failed to disconnect", "device", d.name, "mac", d.mac, "reason", btFailure(output, err))
+		d.state = stateConnected
+		d.setError(fmt.Sprintf("failed to disconnect %s: %s", d.name, btFailure(output, err)))
+		return
+	}
+
+	d.onDisconnected()
+}
+
+// doRemove disconnects the device and drops it from the menu, removing the pairing or moving it
+// to the other devices
+func (d *device) doRemove(kind opKind) {
+	d.doDisconnect()
+
+	localMtx.Lock()
+	if d.state != stateIdle {
+		// failed to disconnect, already reported
+		localMtx.Unlock()
+		return
+	}
+	d.stopReconnect()
+	localMtx.Unlock()
+
+	cmd := "remove"
+	if kind == opHide {
+		cmd = "info"
+	}
+	output, err := d.bt(context.Background(), cmd)
+
+	localMtx.Lock()
+	defer localMtx.Unlock()
+
+	switch {
+	case kind == opHide:
+		btLog.Info("hiding device", "device", d.name, "mac", d.mac)
+		updateConfig(d.mac, func(c *deviceConfig) { c.Visibility = "hide" })
+		addOtherDevice(d.mac, d.name, output)
+	case err != nil:
+		d.setError(fmt.Sprintf("failed to forget %s: %s", d.name, btFailure(output, err)))
+		return
+	default:
+		btLog.Info("forgot device", "device", d.name, "mac", d.mac)
+	}
+	d.remove()
+}
+
+// remove drops the device from the menu, its worker exits once done with the current request.
+// localMtx must be held.
+func (d *device) remove() {
+	if d.removed {
+		return
+	}
+	if d.state == stateConnecting {
+		d.cancelConnect()
+	}
+	if d.connected() {
+		d.onDisconnected()
+	}
+	d.stopReconnect()
+	delete(localEndpoints, d.mac)
+	d.removed = true
+	d.menu.Hide()
+	close(d.ops) // queue checks removed, nothing is sent anymore
+}
+
+// onConnected updates the ui and audio once the device is connected. localMtx must be held.
+func (d *device) onConnected() {
+	btLog.Info("connected", "device", d.name, "mac", d.mac)
+	d.state = stateConnected
+	d.away = false
+	d.err = ""
+	d.reconnect = ""
+	d.menu.Check()
+	d.refreshLabel()
+	setTrayConnected(d.name, "")
+	go notify(notifyConnect, "Connected", "Connected to "+d.name)
+
+	go func() {
+		updateConfig(d.mac, func(c *deviceConfig) { c.LastUsed = time.Now().Unix() })
+		volume := d.restoreVolume()
+		setDefaultAudio(d.mac)
+		useBluetoothSource(d.mac, 1) // if it's already on the headset profile
+		options := codecOptions(d.mac)
+		d.restoreCodec(options)
+		codec := activeCodec(d.mac)
+		info, err := d.bt(context.Background(), "info")
+
+		localMtx.Lock()
+		defer localMtx.Unlock()
+		d.setCodec(codec)
+		if d.connected() {
+			d.volume = volume
+			d.refreshLabel()
+		}
+		d.setCodecOptions(options)
+		if err == nil && d.connected() {
+			updateBattery(d, info)
+		}
+	}()
+}
+
+// onDisconnected updates the ui once the device is disconnected. localMtx must be held.
+func (d *device) onDisconnected() {
+	btLog.Info("disconnected", "device", d.name, "mac", d.mac)
+	setTrayDisconnected(d.name)
+	go restoreDefaultSink()
+	go restoreDefaultSource()
+	d.state = stateIdle
+	d.dropExpected = false
+	d.menu.Uncheck()
+	d.battery = -1
+	d.codec = ""
+	d.volume = -1
+	d.setCodecOptions(nil)
+	d.err = ""
+	d.refreshLabel()
+}
+
+// connectRetryDelay is the backoff before retrying a failed connection. A page timeout means
+// the device didn't answer at all, it's off or out of range: the page already took seconds and
+// hammering it again right away won't help, unlike e.g. a busy adapter.
+func connectRetryDelay(reason string, attempt int) time.Duration {
+	base := 500 * time.Millisecond
+	if unreachable(reason) {
+		base = 3 * time.Second
+	}
+	return base << attempt
+}
+
+// unreachable tells if a connection failed because the device didn't answer
+func unreachable(reason string) bool {
+	return strings.Contains(reason, "page-timeout") || strings.Contains(reason, "Page Timeout") || strings.Contains(reason, "Host is down")
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectRetryDelay(t *testing.T) {
+	tests := []struct {
+		reason  string
+		attempt int
+		want    time.Duration
+	}{
+		{"Failed to connect: org.bluez.Error.Failed br-connection-busy", 0, 500 * time.Millisecond},
+		{"Failed to connect: org.bluez.Error.Failed br-connection-busy", 1, time.Second},
+		{"Failed to connect: org.bluez.Error.InProgress", 2, 2 * time.Second},
+		{"Failed to connect: org.bluez.Error.Failed br-connection-page-timeout", 0, 3 * time.Second},
+		{"Failed to connect: org.bluez.Error.Failed br-connection-page-timeout", 1, 6 * time.Second},
+		{"Failed to connect: org.bluez.Error.Failed Page Timeout", 0, 3 * time.Second},
+		{"Failed to connect: org.bluez.Error.Failed Host is down", 2, 12 * time.Second},
+		{"", 0, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := connectRetryDelay(tt.reason, tt.attempt); got != tt.want {
+			t.Errorf("connectRetryDelay(%q, %d) = %s, want %s", tt.reason, tt.attempt, got, tt.want)
+		}
+	}
+}